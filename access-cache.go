@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the cache is cleared when it grows larger than this
+const maxAccessEntries = 10000
+
+// stat of .ghs.yml and .ghsignore is a round trip for remote storages like s3, so their
+// changes are checked at most once in this interval
+const remoteAccessTTL = 10 * time.Second
+
+// accessEntry is the merged access config of a directory
+type accessEntry struct {
+	conf    AccessConf
+	sources []string // .ghs.yml files applied, from root down
+	version uint64
+	parent  uint64    // version of the parent entry when built, generation of the cache for root
+	modTime time.Time // of the .ghs.yml in the directory
+	size    int64     // of the .ghs.yml in the directory, -1 if not exists
+
+	ignoreModTime time.Time // of the .ghsignore in the directory
+	ignoreSize    int64     // of the .ghsignore in the directory, -1 if not exists
+	checkedAt     int64     // unix nano of the last stat, accessed atomically
+}
+
+// accessCache keeps merged .ghs.yml of every directory. An entry is rebuilt when the .ghs.yml
+// or .ghsignore of the directory is modified or the entry of the parent directory is rebuilt.
+type accessCache struct {
+	mu         sync.RWMutex
+	entries    map[string]*accessEntry
+	version    uint64
+	generation uint64
+}
+
+func (c *accessCache) get(key string) *accessEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.entries[key]
+}
+
+func (c *accessCache) put(key string, e *accessEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil || len(c.entries) >= maxAccessEntries {
+		c.entries = make(map[string]*accessEntry)
+	}
+	c.entries[key] = e
+}
+
+// invalidate drops all entries, called when the default access changed
+func (c *accessCache) invalidate() {
+	atomic.AddUint64(&c.generation, 1)
+}
+
+func compileAccessTables(tables []AccessTable) []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, len(tables))
+	for i, table := range tables {
+		patterns[i], _ = regexp.Compile(table.Regex) // nil for wrong format regex
+	}
+	return patterns
+}
+
+// dirAccess returns the merged access config of relDir, the path relative to root.
+// Root of a mount starts from the defaults of the mount instead of the parent directory.
+func (s *HTTPStaticServer) dirAccess(relDir string) *accessEntry {
+	relDir = path.Clean("/" + relDir)
+	m := s.mount(relDir)
+	var parent *accessEntry
+	parentVersion := atomic.LoadUint64(&s.acl.generation)
+	if relDir != "/" && !s.isMountPoint(relDir) {
+		parent = s.dirAccess(path.Dir(relDir))
+		parentVersion = parent.version
+	}
+	cached := s.acl.get(relDir)
+	if cached != nil && cached.parent == parentVersion && s.Storage != nil &&
+		time.Since(time.Unix(0, atomic.LoadInt64(&cached.checkedAt))) < remoteAccessTTL {
+		return cached
+	}
+
+	cfgFile := filepath.Join(s.realPathOf(relDir), YAMLCONF)
+	var modTime time.Time
+	var size int64 = -1
+	if info, err := s.fs().Stat(cfgFile); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+	ignoreFile := filepath.Join(s.realPathOf(relDir), IGNOREFILE)
+	var ignoreModTime time.Time
+	var ignoreSize int64 = -1
+	if info, err := s.fs().Stat(ignoreFile); err == nil {
+		ignoreModTime, ignoreSize = info.ModTime(), info.Size()
+	}
+	if e := cached; e != nil && e.parent == parentVersion && e.size == size && e.modTime.Equal(modTime) &&
+		e.ignoreSize == ignoreSize && e.ignoreModTime.Equal(ignoreModTime) {
+		atomic.StoreInt64(&e.checkedAt, time.Now().UnixNano())
+		return e
+	}
+
+	e := &accessEntry{
+		version:       atomic.AddUint64(&s.acl.version, 1),
+		parent:        parentVersion,
+		modTime:       modTime,
+		size:          size,
+		ignoreModTime: ignoreModTime,
+		ignoreSize:    ignoreSize,
+		checkedAt:     time.Now().UnixNano(),
+	}
+	if parent == nil {
+		e.conf = s.defaultAccessConf()
+		e.conf.readOnly = isReadOnly(s.fs())
+		if m != nil {
+			e.conf.Upload, e.conf.Delete, e.conf.readOnly = m.Upload, m.Delete, m.ReadOnly
+		}
+		e.conf.ignores = s.hiddenRules(relDir)
+	} else {
+		e.conf = parent.conf
+		e.sources = parent.sources[:len(parent.sources):len(parent.sources)]
+	}
+	if size >= 0 {
+		s.mergeAccessConf(cfgFile, &e.conf)
+		e.conf.source = path.Join(relDir, YAMLCONF)
+		e.sources = append(e.sources, e.conf.source)
+		for i := range e.conf.AccessTables {
+			if e.conf.AccessTables[i].base == "" { // tables defined in this .ghs.yml
+				e.conf.AccessTables[i].base = relDir
+			}
+		}
+	}
+	if ignoreSize >= 0 {
+		if data, err := readStorageFile(s.fs(), ignoreFile); err != nil {
+			log.Printf("Err read %s: %v", IGNOREFILE, err)
+		} else {
+			patterns, err := parseIgnore(data)
+			if err != nil {
+				log.Printf("Err format %s: %v", ignoreFile, err)
+			}
+			ignores := e.conf.ignores[:len(e.conf.ignores):len(e.conf.ignores)]
+			e.conf.ignores = append(ignores, ignoreRules(relDir, patterns)...)
+		}
+	}
+	e.conf.patterns = compileAccessTables(e.conf.AccessTables)
+	s.acl.put(relDir, e)
+	return e
+}
+
+// mergeAccessConf applies cfgFile on top of ac. A .ghs.yml which can not be read or has
+// errors denies everything in the directory, instead of dropping the broken rules.
+func (s *HTTPStaticServer) mergeAccessConf(cfgFile string, ac *AccessConf) {
+	data, err := readStorageFile(s.fs(), cfgFile)
+	if err == nil {
+		err = parseAccessConf(data, ac)
+	}
+	if err != nil {
+		log.Printf("Err format %s, everything under it is denied: %v", cfgFile, err)
+		ac.Read, ac.List, ac.Upload, ac.Delete = false, false, false, false
+		ac.Users = nil
+		ac.AccessTables = []AccessTable{{Regex: ".*", Action: ActionDeny}}
+	}
+}
+
+func (s *HTTPStaticServer) readAccessConf(realPath string) (ac AccessConf) {
+	relPath := s.relativePath(realPath)
+	relDir := relPath
+	if s.isFile(realPath) {
+		relDir = path.Dir(relPath)
+	}
+	ac = s.dirAccess(relDir).conf
+	ac.path = relPath
+	return
+}
+
+// hDebugACL shows the merged access config of a path, tokens of users are hidden.
+// action is the access table action for the admin who requests it.
+func (s *HTTPStaticServer) hDebugACL(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		http.Error(w, "Admin required", http.StatusForbidden)
+		return
+	}
+	relPath := path.Clean("/" + r.FormValue("path"))
+	realPath := s.realPathOf(relPath)
+	relDir := relPath
+	if s.isFile(realPath) {
+		relDir = path.Dir(relPath)
+	}
+	e := s.dirAccess(relDir)
+	_, err := s.fs().Stat(realPath)
+	sources := e.sources
+	if sources == nil {
+		sources = []string{}
+	}
+	users := make([]UserControl, len(e.conf.Users))
+	for i, user := range e.conf.Users {
+		if user.Token != "" {
+			user.Token = "******"
+		}
+		users[i] = user
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":         relPath,
+		"exists":       err == nil,
+		"sources":      sources,
+		"read":         e.conf.Read,
+		"list":         e.conf.List,
+		"upload":       e.conf.Upload,
+		"delete":       e.conf.Delete,
+		"denyStatus":   e.conf.DenyStatus,
+		"users":        users,
+		"accessTables": e.conf.AccessTables,
+		"action":       e.conf.action(r, relPath),
+		"hidden":       e.conf.hidden(relPath),
+	})
+}
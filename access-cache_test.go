@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessCache(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "foo", "bar")
+	assert.NoError(t, os.MkdirAll(sub, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "foo", YAMLCONF), []byte("upload: true\n"), 0644))
+	s := &HTTPStaticServer{Root: root + "/"}
+
+	ac := s.readAccessConf(sub)
+	assert.True(t, ac.Upload)
+	assert.False(t, ac.Delete)
+	assert.Equal(t, "/foo/.ghs.yml", ac.source)
+	assert.Equal(t, "/foo/bar", ac.path)
+	assert.Equal(t, []string{"/foo/.ghs.yml"}, s.dirAccess("/foo/bar").sources)
+
+	// change of a parent .ghs.yml is applied to sub directories
+	cfgFile := filepath.Join(root, "foo", YAMLCONF)
+	assert.NoError(t, ioutil.WriteFile(cfgFile, []byte("upload: false\ndelete: true\naccessTables:\n- regex: secret\n  allow: false\n"), 0644))
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(cfgFile, future, future))
+	ac = s.readAccessConf(sub)
+	assert.False(t, ac.Upload)
+	assert.True(t, ac.Delete)
+	assert.False(t, ac.visible(nil, "/foo/bar/secret.txt"))
+
+	// default access is applied after invalidate
+	s.Upload = true
+	assert.NoError(t, os.Remove(cfgFile))
+	s.acl.invalidate()
+	ac = s.readAccessConf(sub)
+	assert.True(t, ac.Upload)
+	assert.Equal(t, "", ac.source)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ac := s.readAccessConf(sub)
+				ac.visible(nil, "/foo/bar/foo.txt")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// statCounter counts Stat of the wrapped storage
+type statCounter struct {
+	localStorage
+	mu    sync.Mutex
+	stats int
+}
+
+func (fs *statCounter) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	fs.stats++
+	fs.mu.Unlock()
+	return fs.localStorage.Stat(name)
+}
+
+func TestAccessCacheRemoteStorage(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "a", "b", "c")
+	assert.NoError(t, os.MkdirAll(sub, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "a", YAMLCONF), []byte("upload: true\n"), 0644))
+	fs := &statCounter{}
+	s := &HTTPStaticServer{Root: root + "/", Storage: fs}
+
+	assert.True(t, s.dirAccess("/a/b/c").conf.Upload)
+	assert.NotZero(t, fs.stats)
+	fs.stats = 0
+	assert.True(t, s.dirAccess("/a/b/c").conf.Upload)
+	assert.Zero(t, fs.stats, "checked again only after the ttl")
+
+	// invalidate still applies at once
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "a", YAMLCONF), []byte("upload: false\n"), 0644))
+	s.acl.invalidate()
+	assert.False(t, s.dirAccess("/a/b/c").conf.Upload)
+}
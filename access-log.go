@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	accesslog "github.com/codeskyblue/go-accesslog"
+)
+
+const customRecordUser = "user"
+
+// httpLogger writes access log with format default|common|combined|json,
+// records go to the application log when there is no Writer
+type httpLogger struct {
+	Format string
+	Writer io.Writer
+}
+
+func newHTTPLogger(filename, format string, maxSize int64, maxBackups int, rotate string) (*httpLogger, error) {
+	switch format {
+	case "", "default", "common", "combined", "json":
+	default:
+		return nil, fmt.Errorf("invalid access log format %s, must be one of default|common|combined|json", strconv.Quote(format))
+	}
+	l := &httpLogger{Format: format}
+	if filename == "" {
+		return l, nil
+	}
+	var interval time.Duration
+	switch rotate {
+	case "":
+	case "hourly":
+		interval = time.Hour
+	case "daily":
+		interval = 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("invalid access log rotate %s, must be hourly or daily", strconv.Quote(rotate))
+	}
+	w, err := NewRotateWriter(filename, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	w.Interval = interval
+	l.Writer = w
+	return l, nil
+}
+
+func (l *httpLogger) Log(record accesslog.LogRecord) {
+	line := l.format(record)
+	if l.Writer == nil {
+		log.Print(line)
+		return
+	}
+	if _, err := io.WriteString(l.Writer, line+"\n"); err != nil {
+		log.Println("access log:", err)
+	}
+}
+
+func (l *httpLogger) format(record accesslog.LogRecord) string {
+	user := record.CustomRecords[customRecordUser]
+	if user == "" {
+		user = "-"
+	}
+	switch l.Format {
+	case "common", "combined":
+		size := "-"
+		if record.Size > 0 {
+			size = strconv.FormatInt(record.Size, 10)
+		}
+		line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+			record.Ip, user, record.Time.Local().Format("02/Jan/2006:15:04:05 -0700"),
+			record.Method, record.Uri, record.Protocol, record.Status, size)
+		if l.Format == "combined" {
+			line += fmt.Sprintf(" %s %s", clfQuote(record.RequestHeader.Get("Referer")), clfQuote(record.RequestHeader.Get("User-Agent")))
+		}
+		return line
+	case "json":
+		data, _ := json.Marshal(map[string]interface{}{
+			"time":      record.Time.Format(time.RFC3339Nano),
+			"ip":        record.Ip,
+			"user":      user,
+			"method":    record.Method,
+			"uri":       record.Uri,
+			"protocol":  record.Protocol,
+			"host":      record.Host,
+			"status":    record.Status,
+			"bytes":     record.Size,
+			"duration":  record.ElapsedTime.Seconds(),
+			"referer":   record.RequestHeader.Get("Referer"),
+			"userAgent": record.RequestHeader.Get("User-Agent"),
+		})
+		return string(data)
+	default:
+		return fmt.Sprintf("%s - %s %d %s", record.Ip, record.Method, record.Status, record.Uri)
+	}
+}
+
+func clfQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// logUser returns name of the authenticated user for access log
+func logUser(r *http.Request) string {
+	if token := requestToken(r); token != nil {
+		if token.Owner != "" {
+			return token.Owner
+		}
+		return "token:" + token.ID
+	}
+	if user := currentUser(r); user != nil {
+		return user.Email
+	}
+	if name, _, ok := r.BasicAuth(); ok && gcfg.Auth.Type == "http" {
+		return name
+	}
+	return ""
+}
+
+// withLogUser must be put just inside the logging handler, it adds the user to the log record
+func withLogUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if lw, ok := w.(*accesslog.LoggingWriter); ok {
+			if user := logUser(r); user != "" {
+				lw.SetCustomLogRecord(customRecordUser, user)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	accesslog "github.com/codeskyblue/go-accesslog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPLoggerFormat(t *testing.T) {
+	record := accesslog.LogRecord{
+		Time:          time.Date(2021, 6, 1, 10, 0, 0, 0, time.FixedZone("", 8*3600)),
+		Ip:            "10.0.0.3",
+		Method:        "GET",
+		Uri:           "/a.txt",
+		Protocol:      "HTTP/1.1",
+		Status:        200,
+		Size:          1024,
+		RequestHeader: http.Header{"User-Agent": []string{"curl/7.0"}},
+		CustomRecords: map[string]string{customRecordUser: "alice@example.com"},
+	}
+	date := record.Time.Local().Format("02/Jan/2006:15:04:05 -0700")
+
+	l := &httpLogger{Format: "common"}
+	assert.Equal(t, `10.0.0.3 - alice@example.com [`+date+`] "GET /a.txt HTTP/1.1" 200 1024`, l.format(record))
+	l.Format = "combined"
+	assert.Equal(t, `10.0.0.3 - alice@example.com [`+date+`] "GET /a.txt HTTP/1.1" 200 1024 "-" "curl/7.0"`, l.format(record))
+	l.Format = ""
+	assert.Equal(t, "10.0.0.3 - GET 200 /a.txt", l.format(record))
+	l.Format = "json"
+	assert.Contains(t, l.format(record), `"user":"alice@example.com"`)
+
+	_, err := newHTTPLogger("", "apache", 0, 0, "")
+	assert.Error(t, err)
+}
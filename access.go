@@ -0,0 +1,442 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	dkignore "github.com/codeskyblue/dockerignore"
+)
+
+// Roles can be used in the users section of .ghs.yml instead of listing every permission
+const (
+	RoleReader     = "reader"
+	RoleUploader   = "uploader"
+	RoleMaintainer = "maintainer"
+)
+
+// Actions of accessTables
+const (
+	ActionAllow        = "allow"         // visible and downloadable, no more rules are tried
+	ActionHide         = "hide"          // hidden from listing and search, still downloadable by url
+	ActionDeny         = "deny"          // hidden and not downloadable
+	ActionDenyDownload = "deny-download" // listed but not downloadable
+	ActionReadOnly     = "read-only"     // no upload, overwrite or delete
+)
+
+var accessActions = []string{ActionAllow, ActionHide, ActionDeny, ActionDenyDownload, ActionReadOnly}
+
+// AccessTable matches files by Regex on the file name, or by Glob on the path relative to
+// the directory of the .ghs.yml. The first matched table decides the action.
+type AccessTable struct {
+	Regex  string   `yaml:"regex"`
+	Glob   string   `yaml:"glob"` // gitignore style, eg: *.map, /build/*/intermediates/**
+	Allow  bool     `yaml:"allow"`
+	Action string   `yaml:"action"` // allow|hide|deny|deny-download|read-only, "allow: false" means hide
+	Users  []string `yaml:"users"`  // email, wildcard email or group:<name>, everyone if empty
+
+	base string // directory of the .ghs.yml, relative to root
+}
+
+func (t AccessTable) action() string {
+	if t.Action != "" {
+		return t.Action
+	}
+	if t.Allow {
+		return ActionAllow
+	}
+	return ActionHide
+}
+
+// globPattern converts Glob to the pattern of dockerignore, patterns without slash match in all directories
+func (t AccessTable) globPattern() string {
+	if strings.HasPrefix(t.Glob, "/") {
+		return strings.TrimPrefix(t.Glob, "/")
+	}
+	if !strings.Contains(strings.TrimSuffix(t.Glob, "/"), "/") {
+		return "**/" + t.Glob
+	}
+	return t.Glob
+}
+
+// match reports whether relPath (relative to root with leading /) matches the table
+func (t AccessTable) match(pattern *regexp.Regexp, relPath string) bool {
+	if t.Glob == "" {
+		return pattern != nil && pattern.MatchString(path.Base(relPath))
+	}
+	base := strings.TrimSuffix(t.base, "/") + "/"
+	if !strings.HasPrefix(relPath, base) || relPath == base {
+		return false
+	}
+	matched, _ := dkignore.Matches(relPath[len(base):], []string{t.globPattern()})
+	return matched
+}
+
+func (t AccessTable) appliesTo(user *UserInfo) bool {
+	if len(t.Users) == 0 {
+		return true
+	}
+	for _, u := range t.Users {
+		if userPattern(u).match(user) != matchNone {
+			return true
+		}
+	}
+	return false
+}
+
+// UserControl matches users by Email (wildcards like *@example.com are supported),
+// by Group or by Token. When several rules match the same user, the most specific
+// one wins: exact email, then wildcard email, then group. Rules of the same kind
+// are tried in the order they are written.
+type UserControl struct {
+	Email string
+	Group string
+	Role  string
+	// Read and List fall back to the directory setting when not set
+	Read   *bool
+	List   *bool
+	Upload bool
+	Delete bool
+	Token  string
+}
+
+type AccessConf struct {
+	Read         bool          `yaml:"read" json:"read"`
+	List         bool          `yaml:"list" json:"list"`
+	Upload       bool          `yaml:"upload" json:"upload"`
+	Delete       bool          `yaml:"delete" json:"delete"`
+	Users        []UserControl `yaml:"users" json:"users"`
+	AccessTables []AccessTable `yaml:"accessTables"`
+	// DenyStatus is the status code when read or list is denied, 403 or 404
+	DenyStatus int `yaml:"denyStatus" json:"-"`
+
+	path     string           // path relative to root, used by api tokens
+	source   string           // the nearest .ghs.yml which applied, relative to root
+	patterns []*regexp.Regexp // compiled AccessTables
+	readOnly bool             // inside of a read-only mount or storage
+	ignores  []ignoreRule     // hidden files of the server config and .ghsignore files, from root down
+}
+
+// rule specificity, higher wins
+const (
+	matchNone = iota
+	matchGroup
+	matchWildcard
+	matchEmail
+)
+
+func (u UserControl) canRead(dflt bool) bool {
+	if u.Read != nil {
+		return *u.Read
+	}
+	return u.Role != "" || dflt // every role is able to read
+}
+
+func (u UserControl) canList(dflt bool) bool {
+	if u.List != nil {
+		return *u.List
+	}
+	return u.Role != "" || dflt
+}
+
+func (u UserControl) canUpload() bool {
+	return u.Upload || u.Role == RoleUploader || u.Role == RoleMaintainer
+}
+
+func (u UserControl) canDelete() bool {
+	return u.Delete || u.Role == RoleMaintainer
+}
+
+// match returns how specific the rule matches the user, matchNone if not matched
+func (u UserControl) match(user *UserInfo) int {
+	if user == nil {
+		return matchNone
+	}
+	if u.Email != "" {
+		if strings.EqualFold(u.Email, user.Email) {
+			return matchEmail
+		}
+		if strings.Contains(u.Email, "*") && matchEmailPattern(u.Email, user.Email) {
+			return matchWildcard
+		}
+		return matchNone
+	}
+	if u.Group != "" {
+		for _, group := range userGroups(user) {
+			if group == u.Group {
+				return matchGroup
+			}
+		}
+	}
+	return matchNone
+}
+
+// matchUser returns the most specific rule which matches the user
+func (c *AccessConf) matchUser(user *UserInfo) (rule UserControl, ok bool) {
+	best := matchNone
+	for _, u := range c.Users {
+		if level := u.match(user); level > best {
+			rule, best = u, level
+		}
+	}
+	return rule, best != matchNone
+}
+
+func matchEmailPattern(pattern, email string) bool {
+	if email == "" {
+		return false
+	}
+	matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(email))
+	return matched
+}
+
+// userGroups returns groups reported by the auth provider together with
+// groups defined in the main config which list the user as a member
+func userGroups(user *UserInfo) []string {
+	groups := append([]string{}, user.Groups...)
+	cfgMu.RLock()
+	configGroups := gcfg.Groups // replaced as a whole by reload, never modified
+	cfgMu.RUnlock()
+	for name, members := range configGroups {
+		for _, member := range members {
+			if strings.EqualFold(member, user.Email) || matchEmailPattern(member, user.Email) {
+				groups = append(groups, name)
+				break
+			}
+		}
+	}
+	return groups
+}
+
+// isAdmin reports whether the request comes from a user listed in admins of the main config,
+// entries can be email, wildcard email or group:<name>. Requests with an admin token are also admin.
+func isAdmin(r *http.Request) bool {
+	if allowed, decided := tokenDecides(r, ScopeAdmin, "/"); decided {
+		return allowed
+	}
+	user := currentUser(r) // the owner for api tokens
+	if user == nil {
+		return false
+	}
+	cfgMu.RLock()
+	admins := gcfg.Admins
+	cfgMu.RUnlock()
+	for _, admin := range admins {
+		if userPattern(admin).match(user) != matchNone {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenDecides checks the scope of the api token of r. Tokens with an owner never grant more than the owner has,
+// if the scope allows it the permission is decided by the rules of the owner. Tokens without owner are created by
+// the server operator and are only limited by their scopes and paths.
+func tokenDecides(r *http.Request, scope string, relPath string) (allowed bool, decided bool) {
+	token := requestToken(r)
+	if token == nil {
+		return false, false
+	}
+	if !token.allow(scope, relPath) {
+		return false, true
+	}
+	return true, token.Owner == ""
+}
+
+// userPattern converts email, wildcard email or group:<name> to a rule
+func userPattern(s string) UserControl {
+	if strings.HasPrefix(s, "group:") {
+		return UserControl{Group: strings.TrimPrefix(s, "group:")}
+	}
+	return UserControl{Email: s}
+}
+
+// tableAction returns the action of the first access table which matches relPath, empty if none matches
+func (c *AccessConf) tableAction(r *http.Request, relPath string) string {
+	if len(c.AccessTables) == 0 {
+		return ""
+	}
+	if len(c.patterns) != len(c.AccessTables) {
+		c.patterns = compileAccessTables(c.AccessTables)
+	}
+	relPath = path.Clean("/" + relPath)
+	var user *UserInfo
+	userLoaded := false
+	for i, table := range c.AccessTables {
+		if !table.match(c.patterns[i], relPath) {
+			continue
+		}
+		if len(table.Users) > 0 {
+			if !userLoaded && r != nil {
+				user, userLoaded = currentUser(r), true
+			}
+			if !table.appliesTo(user) {
+				continue
+			}
+		}
+		return table.action()
+	}
+	return ""
+}
+
+// action returns the access table action of relPath, hidden files are always denied
+func (c *AccessConf) action(r *http.Request, relPath string) string {
+	if c.hidden(relPath) {
+		return ActionDeny
+	}
+	return c.tableAction(r, relPath)
+}
+
+// visible reports whether relPath is shown in listing and search
+func (c *AccessConf) visible(r *http.Request, relPath string) bool {
+	action := c.action(r, relPath)
+	return action != ActionHide && action != ActionDeny
+}
+
+// readable reports whether access tables allow downloading relPath
+func (c *AccessConf) readable(r *http.Request, relPath string) bool {
+	action := c.action(r, relPath)
+	return action != ActionDeny && action != ActionDenyDownload
+}
+
+// writable reports whether access tables allow uploading to or deleting relPath
+func (c *AccessConf) writable(r *http.Request, relPath string) bool {
+	if c.readOnly {
+		return false
+	}
+	action := c.action(r, relPath)
+	return action != ActionDeny && action != ActionReadOnly
+}
+
+func (c *AccessConf) canRead(r *http.Request) bool {
+	if !c.readable(r, c.path) {
+		return false
+	}
+	if allowed, decided := tokenDecides(r, ScopeRead, c.path); decided {
+		return allowed
+	}
+	rule, ok := c.matchUser(currentUser(r))
+	if !ok {
+		return c.Read
+	}
+	return rule.canRead(c.Read)
+}
+
+func (c *AccessConf) canList(r *http.Request) bool {
+	if c.action(r, c.path) == ActionDeny {
+		return false
+	}
+	if allowed, decided := tokenDecides(r, ScopeRead, c.path); decided {
+		return allowed
+	}
+	rule, ok := c.matchUser(currentUser(r))
+	if !ok {
+		return c.List
+	}
+	return rule.canList(c.List)
+}
+
+func (c *AccessConf) canDelete(r *http.Request) bool {
+	if !c.writable(r, c.path) {
+		return false
+	}
+	if allowed, decided := tokenDecides(r, ScopeDelete, c.path); decided {
+		return allowed
+	}
+	rule, ok := c.matchUser(currentUser(r))
+	if !ok {
+		return c.Delete
+	}
+	return rule.canDelete()
+}
+
+func (c *AccessConf) canUploadByToken(token string) bool {
+	for _, rule := range c.Users {
+		if rule.Token == token {
+			return rule.canUpload()
+		}
+	}
+	return c.Upload
+}
+
+func (c *AccessConf) canUpload(r *http.Request) bool {
+	if !c.writable(r, c.path) {
+		return false
+	}
+	if allowed, decided := tokenDecides(r, ScopeUpload, c.path); decided {
+		return allowed
+	}
+	token := r.FormValue("token")
+	if token != "" {
+		return c.canUploadByToken(token)
+	}
+	rule, ok := c.matchUser(currentUser(r))
+	if !ok {
+		return c.Upload
+	}
+	return rule.canUpload()
+}
+
+// explain describes the rule which decides the permission of op, used by the audit log
+func (c *AccessConf) explain(r *http.Request, op string) string {
+	if c.hidden(c.path) {
+		return "hidden"
+	}
+	switch action := c.tableAction(r, c.path); {
+	case action == ActionDeny,
+		action == ActionDenyDownload && op == AuditRead,
+		action == ActionReadOnly && op != AuditRead && op != AuditList:
+		return "accessTables " + action
+	}
+	if token := requestToken(r); token != nil {
+		scope := ScopeUpload
+		switch op {
+		case AuditRead, AuditList:
+			scope = ScopeRead
+		case AuditDelete:
+			scope = ScopeDelete
+		}
+		if _, decided := tokenDecides(r, scope, c.path); decided {
+			return "api token " + token.ID
+		}
+	}
+	if op == AuditUpload || op == AuditMkdir || op == AuditUnzip {
+		if token := r.FormValue("token"); token != "" {
+			for i, rule := range c.Users {
+				if rule.Token == token {
+					return fmt.Sprintf("users[%d] token", i)
+				}
+			}
+			return "default"
+		}
+	}
+	best, index := matchNone, -1
+	for i, u := range c.Users {
+		if level := u.match(currentUser(r)); level > best {
+			best, index = level, i
+		}
+	}
+	if index == -1 {
+		return "default"
+	}
+	rule := c.Users[index]
+	desc := fmt.Sprintf("users[%d] email %s", index, rule.Email)
+	if rule.Email == "" {
+		desc = fmt.Sprintf("users[%d] group %s", index, rule.Group)
+	}
+	if rule.Role != "" {
+		desc += " role " + rule.Role
+	}
+	return desc
+}
+
+// forbidden replies 403, or 404 for hidden files and when .ghs.yml wants to hide the existence of files
+func (c *AccessConf) forbidden(w http.ResponseWriter, r *http.Request, message string) {
+	if c.DenyStatus == http.StatusNotFound || c.hidden(c.path) {
+		http.NotFound(w, r)
+		return
+	}
+	http.Error(w, message, http.StatusForbidden)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessConfMatchUser(t *testing.T) {
+	gcfg.Groups = map[string][]string{
+		"qa": {"alice@example.com", "*@qa.example.com"},
+	}
+	defer func() { gcfg.Groups = nil }()
+
+	ac := AccessConf{
+		Users: []UserControl{
+			{Group: "qa", Role: RoleUploader},
+			{Email: "*@example.com", Role: RoleReader},
+			{Email: "bob@example.com", Role: RoleMaintainer},
+			{Group: "ops", Delete: true},
+		},
+	}
+	tests := []struct {
+		user   *UserInfo
+		ok     bool
+		upload bool
+		delete bool
+	}{
+		{nil, false, false, false},
+		{&UserInfo{Email: "bob@example.com"}, true, true, true},
+		{&UserInfo{Email: "Alice@Example.com"}, true, false, false}, // wildcard email beats group
+		{&UserInfo{Email: "carol@qa.example.com"}, true, true, false},
+		{&UserInfo{Email: "dave@other.com", Groups: []string{"ops"}}, true, false, true},
+		{&UserInfo{Email: "eve@other.com"}, false, false, false},
+	}
+	for _, v := range tests {
+		rule, ok := ac.matchUser(v.user)
+		assert.Equal(t, v.ok, ok, "%v", v.user)
+		assert.Equal(t, v.upload, rule.canUpload(), "%v", v.user)
+		assert.Equal(t, v.delete, rule.canDelete(), "%v", v.user)
+	}
+}
+
+func TestAccessTables(t *testing.T) {
+	ac := AccessConf{
+		AccessTables: []AccessTable{
+			{Glob: "build/*/intermediates/**", Action: ActionDeny, base: "/app"},
+			{Glob: "*.map", Action: ActionHide, base: "/app/web"},
+			{Glob: "/releases/", Action: ActionReadOnly, base: "/app"},
+			{Glob: "secret", Action: ActionDenyDownload, Users: []string{"group:qa"}, base: "/"},
+			{Regex: `\.log$`, Allow: false},
+			{Regex: `^keep\.log$`, Allow: true},
+		},
+	}
+	tests := []struct {
+		path   string
+		action string
+	}{
+		{"/app/build/x/intermediates/a.o", ActionDeny},
+		{"/app/build/x/outputs/a.apk", ""},
+		{"/build/x/intermediates/a.o", ""}, // outside of /app
+		{"/app/web/js/main.js.map", ActionHide},
+		{"/app/main.js.map", ""},
+		{"/app/releases", ActionReadOnly},
+		{"/app/releases/v1.zip", ActionReadOnly},
+		{"/app/sub/releases/v1.zip", ""},
+		{"/a/b/secret", ""}, // guest is not in group qa
+		{"/debug.log", ActionHide},
+		{"/keep.log", ActionHide}, // the first matched table wins
+	}
+	for _, v := range tests {
+		assert.Equal(t, v.action, ac.tableAction(nil, v.path), v.path)
+	}
+	assert.False(t, ac.visible(nil, "/app/build/x/intermediates/a.o"))
+	assert.True(t, ac.readable(nil, "/app/web/js/main.js.map"))
+	assert.False(t, ac.writable(nil, "/app/releases/v1.zip"))
+
+	gcfg.Groups = map[string][]string{"qa": {"alice@example.com"}}
+	defer func() { gcfg.Groups = nil }()
+	assert.True(t, ac.AccessTables[3].appliesTo(&UserInfo{Email: "alice@example.com"}))
+	assert.False(t, ac.AccessTables[3].appliesTo(&UserInfo{Email: "bob@example.com"}))
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errReadOnly = errors.New("read-only file system")
+
+// isArchive reports whether name is a zip or tar file which can be served as root
+func isArchive(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(lower, ext) {
+			return isFile(name)
+		}
+	}
+	return false
+}
+
+// archiveEntry is a file or directory of an archive, it is both fs.FileInfo and fs.DirEntry
+type archiveEntry struct {
+	name     string
+	size     int64
+	mode     fs.FileMode
+	modTime  time.Time
+	children []*archiveEntry               // sorted by name, for directories
+	section  *io.SectionReader             // data which can be read at any offset
+	open     func() (io.ReadCloser, error) // compressed data which can only be read from the start
+}
+
+func (e *archiveEntry) Name() string               { return e.name }
+func (e *archiveEntry) Size() int64                { return e.size }
+func (e *archiveEntry) Mode() fs.FileMode          { return e.mode }
+func (e *archiveEntry) ModTime() time.Time         { return e.modTime }
+func (e *archiveEntry) IsDir() bool                { return e.mode.IsDir() }
+func (e *archiveEntry) Sys() interface{}           { return nil }
+func (e *archiveEntry) Type() fs.FileMode          { return e.mode.Type() }
+func (e *archiveEntry) Info() (fs.FileInfo, error) { return e, nil }
+
+// archiveFS is the read-only fs.FS of the regular files and directories in an archive
+type archiveFS struct {
+	files map[string]*archiveEntry // "." is the root
+}
+
+func newArchiveFS(modTime time.Time) *archiveFS {
+	return &archiveFS{files: map[string]*archiveEntry{
+		".": {name: ".", mode: fs.ModeDir | 0555, modTime: modTime},
+	}}
+}
+
+// add puts e at name and creates the missing parent directories, invalid names are ignored
+func (a *archiveFS) add(name string, e *archiveEntry) {
+	name = path.Clean(strings.TrimLeft(filepath.ToSlash(name), "/"))
+	if name == "." || !fs.ValidPath(name) {
+		return
+	}
+	if old, ok := a.files[name]; ok {
+		if old.IsDir() && e.IsDir() {
+			old.modTime = e.modTime
+			return
+		}
+		a.remove(name)
+	}
+	dir := path.Dir(name)
+	parent, ok := a.files[dir]
+	if !ok || !parent.IsDir() {
+		a.add(dir, &archiveEntry{mode: fs.ModeDir | 0555, modTime: e.modTime})
+		parent = a.files[dir]
+	}
+	e.name = path.Base(name)
+	a.files[name] = e
+	i := sort.Search(len(parent.children), func(i int) bool { return parent.children[i].name >= e.name })
+	parent.children = append(parent.children, nil)
+	copy(parent.children[i+1:], parent.children[i:])
+	parent.children[i] = e
+}
+
+func (a *archiveFS) remove(name string) {
+	parent := a.files[path.Dir(name)]
+	for i, child := range parent.children {
+		if child == a.files[name] {
+			parent.children = append(parent.children[:i], parent.children[i+1:]...)
+			break
+		}
+	}
+	for key := range a.files {
+		if key == name || strings.HasPrefix(key, name+"/") {
+			delete(a.files, key)
+		}
+	}
+}
+
+func (a *archiveFS) lookup(op, name string) (*archiveEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := a.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (a *archiveFS) Open(name string) (fs.File, error) {
+	e, err := a.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveFile{e: e}, nil
+}
+
+func (a *archiveFS) Stat(name string) (fs.FileInfo, error) {
+	return a.lookup("stat", name)
+}
+
+func (a *archiveFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := a.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries := make([]fs.DirEntry, len(e.children))
+	for i, child := range e.children {
+		entries[i] = child
+	}
+	return entries, nil
+}
+
+// archiveFile reads an entry, compressed entries are read again from the start when seeking backward
+type archiveFile struct {
+	e      *archiveEntry
+	pos    int64
+	rc     io.ReadCloser
+	rcPos  int64
+	dirPos int
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) {
+	return f.e, nil
+}
+
+func (f *archiveFile) Read(p []byte) (n int, err error) {
+	if f.e.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.e.name, Err: errors.New("is a directory")}
+	}
+	if f.pos >= f.e.size {
+		return 0, io.EOF
+	}
+	if f.e.section != nil {
+		n, err = f.e.section.ReadAt(p, f.pos)
+		f.pos += int64(n)
+		return
+	}
+	if f.rc == nil || f.rcPos > f.pos {
+		f.Close()
+		if f.rc, err = f.e.open(); err != nil {
+			return 0, err
+		}
+		f.rcPos = 0
+	}
+	if _, err = io.CopyN(ioutil.Discard, f.rc, f.pos-f.rcPos); err != nil {
+		return 0, err
+	}
+	n, err = f.rc.Read(p)
+	f.pos += int64(n)
+	f.rcPos = f.pos
+	return
+}
+
+func (f *archiveFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if f.e.section != nil {
+		return f.e.section.ReadAt(p, off)
+	}
+	pos := f.pos
+	defer func() { f.pos = pos }()
+	f.pos = off
+	n, err = io.ReadFull(f, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return
+}
+
+func (f *archiveFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.e.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.e.name, Err: fs.ErrInvalid}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *archiveFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	children := f.e.children[f.dirPos:]
+	if n > 0 && len(children) > n {
+		children = children[:n]
+	}
+	if n > 0 && len(children) == 0 {
+		return nil, io.EOF
+	}
+	f.dirPos += len(children)
+	entries := make([]fs.DirEntry, len(children))
+	for i, child := range children {
+		entries[i] = child
+	}
+	return entries, nil
+}
+
+func (f *archiveFile) Close() error {
+	if f.rc == nil {
+		return nil
+	}
+	err := f.rc.Close()
+	f.rc = nil
+	return err
+}
+
+// openArchive reads the file list of a zip, tar, tar.gz or tgz file.
+// tar.gz is decompressed into a temporary file, so that every entry can be read at any offset.
+func openArchive(name string) (*archiveFS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	lower := strings.ToLower(name)
+	var a *archiveFS
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		a, err = readZipArchive(f, info)
+	case strings.HasSuffix(lower, ".tar"):
+		a, err = readTarArchive(f, info)
+	default:
+		var tmp *os.File
+		if tmp, err = gunzipToTemp(f); err == nil {
+			f.Close()
+			f = tmp
+			a, err = readTarArchive(f, info)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return a, nil
+}
+
+func readZipArchive(f *os.File, info os.FileInfo) (*archiveFS, error) {
+	zr, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	a := newArchiveFS(info.ModTime())
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		if mode.IsDir() {
+			a.add(zf.Name, &archiveEntry{mode: fs.ModeDir | 0555, modTime: zf.Modified})
+			continue
+		}
+		if !mode.IsRegular() || zf.Flags&0x1 != 0 { // symlinks and encrypted files
+			continue
+		}
+		e := &archiveEntry{mode: 0444, modTime: zf.Modified, size: int64(zf.UncompressedSize64), open: zf.Open}
+		if zf.Method == zip.Store {
+			offset, err := zf.DataOffset()
+			if err != nil {
+				return nil, err
+			}
+			e.section = io.NewSectionReader(f, offset, e.size)
+		}
+		a.add(zf.Name, e)
+	}
+	return a, nil
+}
+
+// offsetReader counts the bytes read, tar.Reader reads whole blocks so the count is the offset of the data
+type offsetReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *offsetReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func readTarArchive(f *os.File, info os.FileInfo) (*archiveFS, error) {
+	cr := &offsetReader{r: f}
+	tr := tar.NewReader(cr)
+	a := newArchiveFS(info.ModTime())
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return a, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			a.add(hdr.Name, &archiveEntry{mode: fs.ModeDir | 0555, modTime: hdr.ModTime})
+		case tar.TypeReg:
+			a.add(hdr.Name, &archiveEntry{mode: 0444, modTime: hdr.ModTime, size: hdr.Size,
+				section: io.NewSectionReader(f, cr.n, hdr.Size)})
+		}
+	}
+}
+
+func gunzipToTemp(f *os.File) (*os.File, error) {
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile("", "ghs-archive-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(tmp.Name()) // removed when closed
+	if _, err = io.Copy(tmp, gr); err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// fsStorage serves an io/fs filesystem read-only, names are slash separated paths from /
+type fsStorage struct {
+	fsys fs.FS
+}
+
+func (s fsStorage) name(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func (s fsStorage) Stat(name string) (os.FileInfo, error) {
+	return fs.Stat(s.fsys, s.name(name))
+}
+
+func (s fsStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(s.fsys, s.name(name))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+func (s fsStorage) Open(name string) (File, error) {
+	f, err := s.fsys.Open(s.name(name))
+	if err != nil {
+		return nil, err
+	}
+	if file, ok := f.(File); ok {
+		return file, nil
+	}
+	f.Close()
+	return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("seek is not supported")}
+}
+
+func (s fsStorage) Create(name string, exclusive bool) (io.WriteCloser, error) {
+	return nil, &os.PathError{Op: "create", Path: name, Err: errReadOnly}
+}
+
+func (s fsStorage) MkdirAll(name string) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: errReadOnly}
+}
+
+func (s fsStorage) RemoveAll(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: errReadOnly}
+}
+
+func (s fsStorage) Rename(oldname, newname string) error {
+	return &os.PathError{Op: "rename", Path: oldname, Err: errReadOnly}
+}
+
+func (s fsStorage) ReadOnly() bool {
+	return true
+}
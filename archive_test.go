@@ -0,0 +1,91 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var archiveFiles = map[string]string{
+	"a.txt":         "0123456789",
+	"docs/b.txt":    "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+	"docs/sub/c.md": "# c",
+}
+
+func writeTestArchives(t *testing.T, dir string) {
+	zf, _ := os.Create(filepath.Join(dir, "test.zip"))
+	zw := zip.NewWriter(zf)
+	zw.Create("docs/")
+	for _, name := range []string{"a.txt", "docs/b.txt", "docs/sub/c.md"} {
+		method := zip.Deflate
+		if name == "a.txt" {
+			method = zip.Store
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		assert.Nil(t, err)
+		io.WriteString(w, archiveFiles[name])
+	}
+	zw.Close()
+	zf.Close()
+
+	tf, _ := os.Create(filepath.Join(dir, "test.tar.gz"))
+	gw := gzip.NewWriter(tf)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: "./docs/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, name := range []string{"a.txt", "docs/b.txt", "docs/sub/c.md"} {
+		tw.WriteHeader(&tar.Header{Name: "./" + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(archiveFiles[name]))})
+		io.WriteString(tw, archiveFiles[name])
+	}
+	tw.WriteHeader(&tar.Header{Name: "../escape.txt", Typeflag: tar.TypeReg, Mode: 0644})
+	tw.Close()
+	gw.Close()
+	tf.Close()
+}
+
+func TestArchiveStorage(t *testing.T) {
+	dir := t.TempDir()
+	writeTestArchives(t, dir)
+	for _, name := range []string{"test.zip", "test.tar.gz"} {
+		assert.True(t, isArchive(filepath.Join(dir, name)))
+		a, err := openArchive(filepath.Join(dir, name))
+		assert.Nil(t, err, name)
+		assert.Nil(t, fstest.TestFS(a, "a.txt", "docs/b.txt", "docs/sub/c.md"), name)
+
+		fs := fsStorage{a}
+		assert.True(t, isReadOnly(fs))
+		infos, err := fs.ReadDir("/")
+		assert.Nil(t, err)
+		assert.Len(t, infos, 2, name)
+		info, err := fs.Stat("/docs/sub")
+		assert.Nil(t, err)
+		assert.True(t, info.IsDir())
+		_, err = fs.Stat("/escape.txt")
+		assert.True(t, os.IsNotExist(err))
+
+		for _, file := range []string{"/a.txt", "/docs/b.txt"} {
+			f, err := fs.Open(file)
+			assert.Nil(t, err)
+			buf := make([]byte, 3)
+			n, err := f.ReadAt(buf, 7)
+			assert.Nil(t, err)
+			assert.Equal(t, archiveFiles[file[1:]][7:10], string(buf[:n]), name+file)
+			f.Seek(8, io.SeekStart)
+			data, _ := ioutil.ReadAll(f)
+			assert.Equal(t, archiveFiles[file[1:]][8:], string(data), name+file)
+			f.Close()
+		}
+
+		_, err = fs.Create("/new.txt", false)
+		assert.Error(t, err)
+		assert.Error(t, fs.RemoveAll("/a.txt"))
+	}
+	assert.False(t, isArchive(dir))
+}
@@ -27,6 +27,20 @@ function checkPathNameLegal(name) {
   return r == null;
 }
 
+function getCookie(name) {
+  var match = document.cookie.match(new RegExp("(^|;\\s*)" + name + "=([^;]*)"));
+  return match ? decodeURIComponent(match[2]) : "";
+}
+
+// send csrf token with all the state-changing requests
+$.ajaxSetup({
+  beforeSend: function (xhr, settings) {
+    if (!/^(GET|HEAD|OPTIONS)$/i.test(settings.type)) {
+      xhr.setRequestHeader("X-CSRF-Token", getCookie("ghs-csrf"));
+    }
+  }
+});
+
 function showErrorMessage(jqXHR) {
   let errMsg = jqXHR.getResponseHeader("x-auth-authentication-message")
   if (errMsg == null) {
@@ -56,6 +70,7 @@ var vm = new Vue({
     version: "loading",
     mtimeTypeFromNow: false, // or fromNow
     auth: {},
+    stats: false, // download statistics enabled
     search: getQueryString("search"),
     files: [{
       name: "loading ...",
@@ -127,6 +142,9 @@ var vm = new Vue({
     this.myDropzone = new Dropzone("#upload-form", {
       paramName: "file",
       maxFilesize: 10240,
+      headers: {
+        "X-CSRF-Token": getCookie("ghs-csrf"),
+      },
       addRemoveLinks: true,
       init: function () {
         this.on("uploadprogress", function (file, progress) {
@@ -276,6 +294,35 @@ var vm = new Vue({
         }
       })
     },
+    shareFile: function (f) {
+      var mode = "read";
+      if (f.type == "dir" && this.auth.upload && window.confirm("Share " + f.name + " as an upload only drop box?\n(Cancel to share for download)")) {
+        mode = "upload";
+      }
+      var expires = window.prompt("Share " + f.name + "\nexpires after, eg: 7d, 12h", "7d");
+      if (!expires) {
+        return
+      }
+      var password = window.prompt("Password, leave empty for no password", "");
+      var maxDownloads = mode == "read" ? window.prompt("Max downloads, 0 for no limit", "0") : "0";
+      $.ajax({
+        url: pathJoin([window.URL_PFEFIX || "", "/-/share"]),
+        method: "POST",
+        data: {
+          path: pathJoin([decodeURI(location.pathname), f.name]).slice(window.URL_PFEFIX.length),
+          mode: mode,
+          expires: expires,
+          password: password || "",
+          "max-downloads": maxDownloads || "0",
+        },
+        success: function (res) {
+          window.prompt("Share link of " + f.name + ", expires at " + moment(res.expiresAt).format('YYYY-MM-DD HH:mm'), res.url);
+        },
+        error: function (jqXHR, textStatus, errorThrown) {
+          showErrorMessage(jqXHR)
+        }
+      })
+    },
     makeDirectory: function () {
       var name = window.prompt("current path: " + location.pathname + "\nplease enter the new directory name", "")
       console.log(name)
@@ -397,11 +444,14 @@ function loadFileList(pathname) {
       dataType: "json",
       cache: false,
       success: function (res) {
-        res.files = _.sortBy(res.files, function (f) {
-          var weight = f.type == 'dir' ? 1000 : 1;
-          return -weight * f.mtime;
-        })
+        if (getQueryString("sort") !== "downloads") { // already sorted by server
+          res.files = _.sortBy(res.files, function (f) {
+            var weight = f.type == 'dir' ? 1000 : 1;
+            return -weight * f.mtime;
+          })
+        }
         vm.files = res.files;
+        vm.stats = res.stats;
         vm.auth = res.auth;
         vm.updateBreadcrumb(pathname);
       },
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operations recorded by the audit log
+const (
+	AuditRead   = "read"
+	AuditList   = "list"
+	AuditUpload = "upload"
+	AuditMkdir  = "mkdir"
+	AuditDelete = "delete"
+	AuditUnzip  = "unzip"
+)
+
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user,omitempty"`
+	AuthMethod string    `json:"auth"`
+	TokenID    string    `json:"tokenId,omitempty"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Op         string    `json:"op"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size,omitempty"`
+	Digest     string    `json:"digest,omitempty"`
+	Allowed    bool      `json:"allowed"`
+	Rule       string    `json:"rule,omitempty"`   // rule which made the decision
+	Source     string    `json:"source,omitempty"` // .ghs.yml which contains the rule
+	Error      string    `json:"error,omitempty"`
+}
+
+// AuditLog writes entries as JSON lines, nil AuditLog drops everything
+type AuditLog struct {
+	w *RotateWriter
+}
+
+func OpenAuditLog(filename string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	w, err := NewRotateWriter(filename, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{w: w}, nil
+}
+
+func (a *AuditLog) Log(e *AuditEntry) {
+	if a == nil {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Println("audit log:", err)
+		return
+	}
+	if _, err := a.w.Write(append(data, '\n')); err != nil {
+		log.Println("audit log:", err)
+	}
+}
+
+type AuditQuery struct {
+	User    string
+	Op      string
+	Path    string // path prefix
+	Allowed *bool
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+func (q *AuditQuery) match(e *AuditEntry) bool {
+	if q.User != "" && !strings.EqualFold(q.User, e.User) {
+		return false
+	}
+	if q.Op != "" && q.Op != e.Op {
+		return false
+	}
+	if q.Path != "" && !strings.HasPrefix(e.Path, q.Path) {
+		return false
+	}
+	if q.Allowed != nil && *q.Allowed != e.Allowed {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// Query returns the latest entries matched, newest first
+func (a *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	entries := make([]AuditEntry, 0)
+	for _, filename := range a.w.Files() {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var e AuditEntry
+			if json.Unmarshal(scanner.Bytes(), &e) != nil || !q.match(&e) {
+				continue
+			}
+			entries = append(entries, e)
+			if len(entries) > q.Limit {
+				entries = entries[1:]
+			}
+		}
+		f.Close()
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// requestAuth returns how the request is authenticated
+func requestAuth(r *http.Request, op string) (method, user, tokenID string) {
+	if token := requestToken(r); token != nil {
+		return "token", token.Owner, token.ID
+	}
+	if key := requestS3Key(r); key != nil {
+		return "s3", key.Email, key.AccessKey
+	}
+	if u := requestSFTPUser(r); u != nil {
+		return "sftp", u.Email, ""
+	}
+	if u := currentUser(r); u != nil {
+		return gcfg.Auth.Type, u.Email, ""
+	}
+	if name, _, ok := r.BasicAuth(); ok && gcfg.Auth.Type == "http" {
+		return "http", name, ""
+	}
+	if op == AuditUpload || op == AuditMkdir || op == AuditUnzip {
+		if r.FormValue("token") != "" {
+			return "ghs-token", "", ""
+		}
+	}
+	return "anonymous", "", ""
+}
+
+// newAuditEntry returns entry of op on the path of c, with the rule which decided it
+func newAuditEntry(r *http.Request, c *AccessConf, op string, allowed bool) *AuditEntry {
+	e := &AuditEntry{
+		Time:       time.Now(),
+		RemoteAddr: getRealIP(r),
+		Op:         op,
+		Path:       c.path,
+		Allowed:    allowed,
+		Rule:       c.explain(r, op),
+		Source:     c.source,
+	}
+	e.AuthMethod, e.User, e.TokenID = requestAuth(r, op)
+	return e
+}
+
+// hAudit queries the audit log, admin only
+func (s *HTTPStaticServer) hAudit(w http.ResponseWriter, r *http.Request) {
+	if s.Audit == nil {
+		http.Error(w, "Audit log is not enabled, set --audit-log to enable", http.StatusNotFound)
+		return
+	}
+	if !isAdmin(r) {
+		http.Error(w, "Admin required", http.StatusForbidden)
+		return
+	}
+	q := AuditQuery{
+		User:  r.FormValue("user"),
+		Op:    r.FormValue("op"),
+		Path:  r.FormValue("path"),
+		Limit: 100,
+	}
+	if v := r.FormValue("allowed"); v != "" {
+		allowed := v == "true"
+		q.Allowed = &allowed
+	}
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := r.FormValue(name); v != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, "Invalid "+name+", RFC3339 format required", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if v := r.FormValue("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > 1000 {
+			http.Error(w, "Invalid limit, must be 1-1000", http.StatusBadRequest)
+			return
+		}
+		q.Limit = limit
+	}
+	entries, err := s.Audit.Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// deny records the denied op and replies with the deny status of .ghs.yml
+func (s *HTTPStaticServer) deny(w http.ResponseWriter, r *http.Request, auth *AccessConf, op string) {
+	s.Audit.Log(newAuditEntry(r, auth, op, false))
+	auth.forbidden(w, r, strings.ToUpper(op[:1])+op[1:]+" forbidden")
+}
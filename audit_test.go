@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghs-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	audit, err := OpenAuditLog(filepath.Join(dir, "audit.log"), 300, 2)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		op := AuditUpload
+		if i%2 == 1 {
+			op = AuditDelete
+		}
+		audit.Log(&AuditEntry{Time: time.Now(), User: "foo@example.com", Op: op, Path: "/a", Allowed: true})
+	}
+	assert.Len(t, audit.w.Files(), 3) // current file and 2 backups
+
+	entries, err := audit.Query(AuditQuery{Op: AuditDelete, Limit: 2})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, AuditDelete, entries[0].Op)
+	assert.False(t, entries[0].Time.Before(entries[1].Time))
+
+	denied := false
+	entries, err = audit.Query(AuditQuery{Allowed: &denied, Limit: 10})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	dkignore "github.com/codeskyblue/dockerignore"
+	"github.com/go-yaml/yaml"
+)
+
+var authTypes = []string{"", "http", "openid", "oauth2-proxy", "header", "mtls"}
+
+// ConfigErrors collects every problem found in a config file
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// confFileError is an error of the main config file
+type confFileError struct {
+	name string
+	err  error
+}
+
+func (e *confFileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.name, e.err)
+}
+
+// unmarshalStrict is yaml.UnmarshalStrict, unknown keys and wrong types are returned as ConfigErrors
+func unmarshalStrict(data []byte, v interface{}) error {
+	err := yaml.UnmarshalStrict(data, v)
+	if te, ok := err.(*yaml.TypeError); ok {
+		return ConfigErrors(te.Errors)
+	}
+	return err
+}
+
+// validateConfig checks the values which yaml decoding can not check
+func validateConfig(cfg *Configure) ConfigErrors {
+	var errs ConfigErrors
+	if !stringInSlice(cfg.Auth.Type, authTypes) {
+		errs = append(errs, fmt.Sprintf("auth.type: unknown type %s, must be one of %s", strconv.Quote(cfg.Auth.Type), strings.Join(authTypes[1:], "|")))
+	}
+	for i, userpass := range cfg.Auth.HTTP {
+		if !strings.Contains(userpass, ":") {
+			errs = append(errs, fmt.Sprintf("auth.http[%d]: must be user:pass", i))
+		}
+	}
+	switch cfg.Auth.ClientVerify {
+	case "", "required", "optional":
+	default:
+		errs = append(errs, "auth.client-verify: must be required or optional")
+	}
+	if _, err := NewHeaderAuth(cfg.Auth.Header.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Sprintf("auth.header.trusted-proxies: %v", err))
+	}
+	switch cfg.AccessLogFormat {
+	case "", "default", "common", "combined", "json":
+	default:
+		errs = append(errs, "access-log-format: must be one of default|common|combined|json")
+	}
+	switch cfg.AccessLogRotate {
+	case "", "hourly", "daily":
+	default:
+		errs = append(errs, "access-log-rotate: must be hourly or daily")
+	}
+	if cfg.RateLimit.Requests < 0 || cfg.RateLimit.Downloads < 0 {
+		errs = append(errs, "rate-limit: requests and downloads must not be negative")
+	}
+	if _, err := parseBandwidth(cfg.RateLimit.Bandwidth); err != nil {
+		errs = append(errs, fmt.Sprintf("rate-limit.bandwidth: %v", err))
+	}
+	if _, err := parseBandwidth(cfg.RateLimit.ConnBandwidth); err != nil {
+		errs = append(errs, fmt.Sprintf("rate-limit.conn-bandwidth: %v", err))
+	}
+	for i, o := range cfg.CORS.Overrides {
+		if !strings.HasPrefix(o.Prefix, "/") {
+			errs = append(errs, fmt.Sprintf("cors.overrides[%d].prefix: must start with /", i))
+		}
+	}
+	for i, pattern := range cfg.Hidden.Patterns {
+		if err := checkIgnorePattern(pattern); err != nil {
+			errs = append(errs, fmt.Sprintf("hidden.patterns[%d]: %v", i, err))
+		}
+	}
+	switch cfg.Symlinks {
+	case "", SymlinkFollow, SymlinkFollowWithinRoot, SymlinkDeny:
+	default:
+		errs = append(errs, "symlinks: must be one of follow|follow-within-root|deny")
+	}
+	if _, err := newStorage(cfg.Storage); err != nil {
+		errs = append(errs, err.Error())
+	} else if cfg.Storage.Type == "s3" && len(cfg.Mounts) > 0 {
+		errs = append(errs, "mounts: not supported with storage s3")
+	}
+	if isArchive(cfg.Root) {
+		if cfg.Storage.Type == "s3" {
+			errs = append(errs, "root: an archive can not be used with storage s3")
+		}
+		if len(cfg.Mounts) > 0 {
+			errs = append(errs, "mounts: not supported when root is an archive")
+		}
+	}
+	prefixes := make(map[string]bool)
+	for i, m := range fixMounts(cfg.Mounts) {
+		if m.Prefix == "/" || m.Prefix == "/-" || strings.Count(m.Prefix, "/") != 1 {
+			errs = append(errs, fmt.Sprintf("mounts[%d].prefix: must be one level like /releases, and not /-", i))
+		} else if prefixes[m.Prefix] {
+			errs = append(errs, fmt.Sprintf("mounts[%d].prefix: %s is mounted more than once", i, m.Prefix))
+		}
+		prefixes[m.Prefix] = true
+		if !isDir(m.Path) {
+			errs = append(errs, fmt.Sprintf("mounts[%d].path: %s is not a directory", i, strconv.Quote(m.Path)))
+		}
+	}
+	if cfg.S3API.Addr != "" {
+		if len(cfg.S3API.Keys) == 0 {
+			errs = append(errs, "s3-api.keys: at least one key is required")
+		}
+		if strings.Contains(cfg.S3API.Bucket, "/") {
+			errs = append(errs, "s3-api.bucket: must not contain /")
+		}
+		accessKeys := make(map[string]bool)
+		for i, k := range cfg.S3API.Keys {
+			if k.AccessKey == "" || k.SecretKey == "" {
+				errs = append(errs, fmt.Sprintf("s3-api.keys[%d]: access-key and secret-key are required", i))
+			} else if accessKeys[k.AccessKey] {
+				errs = append(errs, fmt.Sprintf("s3-api.keys[%d].access-key: %s is defined more than once", i, k.AccessKey))
+			}
+			accessKeys[k.AccessKey] = true
+		}
+	}
+	if cfg.SFTP.Addr != "" {
+		if len(cfg.SFTP.Users) == 0 {
+			errs = append(errs, "sftp.users: at least one user is required")
+		}
+		names := make(map[string]bool)
+		for i, u := range cfg.SFTP.Users {
+			if u.User == "" || (u.Password == "" && len(u.AuthorizedKeys) == 0) {
+				errs = append(errs, fmt.Sprintf("sftp.users[%d]: user and password or authorized-keys are required", i))
+			} else if names[u.User] {
+				errs = append(errs, fmt.Sprintf("sftp.users[%d].user: %s is defined more than once", i, u.User))
+			}
+			names[u.User] = true
+		}
+		if _, err := parseAuthorizedKeys(cfg.SFTP.Users); err != nil {
+			errs = append(errs, err.Error())
+		}
+		if cfg.SFTP.HostKey != "" {
+			if _, err := loadHostKey(cfg.SFTP.HostKey); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	for i, admin := range cfg.Admins {
+		if strings.HasPrefix(admin, "group:") {
+			if _, ok := cfg.Groups[strings.TrimPrefix(admin, "group:")]; !ok && cfg.Auth.Type != "header" && cfg.Auth.Type != "oauth2-proxy" {
+				errs = append(errs, fmt.Sprintf("admins[%d]: group %s is not defined in groups", i, strings.TrimPrefix(admin, "group:")))
+			}
+		}
+	}
+	return errs
+}
+
+// parseAccessConf decodes a .ghs.yml on top of dst, problems are returned as ConfigErrors
+// and dst is only changed when there is none
+func parseAccessConf(data []byte, dst *AccessConf) error {
+	var errs ConfigErrors
+	ac := *dst
+	if err := unmarshalStrict(data, &ac); err != nil {
+		ce, ok := err.(ConfigErrors)
+		if !ok {
+			return err
+		}
+		errs = append(errs, ce...)
+	}
+	for i, table := range ac.AccessTables {
+		if (table.Regex == "") == (table.Glob == "") {
+			errs = append(errs, fmt.Sprintf("accessTables[%d]: one of regex or glob is required", i))
+		}
+		if table.Regex != "" {
+			if _, err := regexp.Compile(table.Regex); err != nil {
+				errs = append(errs, fmt.Sprintf("accessTables[%d].regex: %v", i, err))
+			}
+		}
+		if table.Glob != "" {
+			if _, err := dkignore.Matches("x", []string{table.globPattern()}); err != nil {
+				errs = append(errs, fmt.Sprintf("accessTables[%d].glob: %v", i, err))
+			}
+		}
+		if table.Action != "" && !stringInSlice(table.Action, accessActions) {
+			errs = append(errs, fmt.Sprintf("accessTables[%d].action: unknown action %s, must be one of %s", i, strconv.Quote(table.Action), strings.Join(accessActions, "|")))
+		}
+	}
+	for i, user := range ac.Users {
+		switch user.Role {
+		case "", RoleReader, RoleUploader, RoleMaintainer:
+		default:
+			errs = append(errs, fmt.Sprintf("users[%d].role: unknown role %s, must be one of reader|uploader|maintainer", i, strconv.Quote(user.Role)))
+		}
+		if user.Email == "" && user.Group == "" && user.Token == "" {
+			errs = append(errs, fmt.Sprintf("users[%d]: one of email, group or token is required", i))
+		}
+	}
+	switch ac.DenyStatus {
+	case 0, 403, 404:
+	default:
+		errs = append(errs, "denyStatus: must be 403 or 404")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	*dst = ac
+	return nil
+}
+
+// checkConfig validates the main config and every .ghs.yml under root, mounts or the bucket, returns the number of problems.
+// fileErr is the error of decoding the main config file, nil if there is none.
+func checkConfig(w io.Writer, cfg *Configure, fileErr *confFileError) int {
+	problems := 0
+	report := func(file string, err error) {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintf(w, "%s: %s\n", file, strings.TrimSpace(line))
+			problems++
+		}
+	}
+	confName := "command line"
+	if cfg.Conf != nil {
+		confName = cfg.Conf.Name()
+	}
+	if fileErr != nil {
+		report(fileErr.name, fileErr.err)
+	}
+	if errs := validateConfig(cfg); len(errs) > 0 {
+		report(confName, errs)
+	}
+	if _, err := newStorage(cfg.Storage); err != nil {
+		return problems // reported by validateConfig
+	}
+	fs, err := rootStorage(cfg)
+	if err != nil {
+		report(confName, fmt.Errorf("root: %v", err))
+		return problems
+	}
+	if fs == nil && !isDir(cfg.Root) {
+		report(confName, fmt.Errorf("root: %s is not a directory", cfg.Root))
+		return problems
+	}
+	checked := 0
+	walkFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			report(path, err)
+			return nil
+		}
+		if !info.IsDir() && info.Name() == IGNOREFILE {
+			data, err := readStorageFile(fs, path)
+			if err == nil {
+				_, err = parseIgnore(data)
+			}
+			if err != nil {
+				report(path, err)
+			}
+			return nil
+		}
+		if info.IsDir() || info.Name() != YAMLCONF {
+			return nil
+		}
+		checked++
+		data, err := readStorageFile(fs, path)
+		if err != nil {
+			report(path, err)
+			return nil
+		}
+		if err := parseAccessConf(data, &AccessConf{}); err != nil {
+			report(path, err)
+		}
+		return nil
+	}
+	if fs != nil {
+		where := cfg.Root
+		if cfg.Storage.Type == "s3" {
+			where = "s3://" + cfg.Storage.Bucket
+		}
+		if err := walkStorage(fs, "/", walkFn); err != nil {
+			report(where, err)
+		}
+	} else {
+		fs = localStorage{}
+		walkStorage(fs, cfg.Root, walkFn)
+		for _, m := range cfg.Mounts {
+			if isDir(m.Path) {
+				walkStorage(fs, m.Path, walkFn)
+			}
+		}
+	}
+	fmt.Fprintf(w, "checked %s and %d %s files, %d problems found\n", confName, checked, YAMLCONF, problems)
+	return problems
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAccessConf(t *testing.T) {
+	var ac AccessConf
+	assert.NoError(t, parseAccessConf([]byte("upload: true\nusers:\n- email: a@example.com\n  role: reader\n"), &ac))
+	assert.True(t, ac.Upload)
+
+	ac = AccessConf{}
+	err := parseAccessConf([]byte(`
+uplaod: true
+delete: true
+accessTables:
+- regex: "[x"
+users:
+- role: owner
+denyStatus: 500
+`), &ac)
+	assert.Equal(t, ConfigErrors{
+		"line 2: field uplaod not found in type main.AccessConf",
+		"accessTables[0].regex: error parsing regexp: missing closing ]: `[x`",
+		`users[0].role: unknown role "owner", must be one of reader|uploader|maintainer`,
+		"users[0]: one of email, group or token is required",
+		"denyStatus: must be 403 or 404",
+	}, err)
+	assert.False(t, ac.Delete, "nothing is decoded if there are errors")
+}
+
+func TestAccessConfErrors(t *testing.T) {
+	root := t.TempDir()
+	for name, data := range map[string]string{
+		"a.txt":                  "a",
+		"private/" + YAMLCONF:    "users:\n- emial: alice@example.com\n",
+		"private/b.txt":          "b",
+		"private/sub/c.txt":      "c",
+		"private/ok/" + YAMLCONF: "read: true\nlist: true\n",
+		"private/ok/d.txt":       "d",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755)
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(root, name), []byte(data), 0644))
+	}
+	s := NewHTTPStaticServer(root, true)
+	s.Upload = true
+	for url, status := range map[string]int{
+		"/a.txt":             http.StatusOK,
+		"/private":           http.StatusForbidden,
+		"/private/b.txt":     http.StatusForbidden,
+		"/private/sub/c.txt": http.StatusForbidden,
+		"/private/ok/d.txt":  http.StatusForbidden,
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		assert.Equal(t, status, w.Code, url)
+	}
+	assert.False(t, s.readAccessConf(filepath.Join(root, "private")).Upload)
+}
+
+func TestValidateConfig(t *testing.T) {
+	var cfg Configure
+	assert.Empty(t, validateConfig(&cfg))
+
+	cfg.Auth.Type = "basic"
+	cfg.Auth.HTTP = []string{"admin"}
+	cfg.AccessLogFormat = "xml"
+	cfg.Admins = []string{"group:ops"}
+	cfg.Symlinks = "always"
+	cfg.Hidden.Patterns = []string{"*.bak", "[a"}
+	assert.Equal(t, ConfigErrors{
+		`auth.type: unknown type "basic", must be one of http|openid|oauth2-proxy|header|mtls`,
+		"auth.http[0]: must be user:pass",
+		"access-log-format: must be one of default|common|combined|json",
+		"hidden.patterns[1]: Error in pattern ([a): syntax error in pattern",
+		"symlinks: must be one of follow|follow-within-root|deny",
+		"admins[0]: group ops is not defined in groups",
+	}, validateConfig(&cfg))
+
+	assert.Error(t, unmarshalStrict([]byte("titel: x"), &cfg))
+}
+
+func TestCheckConfig(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, YAMLCONF), []byte("uplaod: true\n"), 0644))
+	cfg := Configure{Root: root}
+	err := unmarshalStrict([]byte("titel: x\n"), &cfg)
+	assert.Error(t, err)
+
+	// an unknown key of the main config does not stop checking .ghs.yml files
+	var out strings.Builder
+	assert.Equal(t, 2, checkConfig(&out, &cfg, &confFileError{name: "config.yml", err: err}))
+	assert.Contains(t, out.String(), "config.yml: line 1: field titel not found")
+	assert.Contains(t, out.String(), YAMLCONF+": line 1: field uplaod not found")
+}
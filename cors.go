@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var defaultCORSMethods = []string{"GET", "HEAD", "POST", "DELETE", "OPTIONS"}
+
+type CORSRule struct {
+	AllowOrigins     []string `yaml:"allow-origins"` // wildcard supported, eg: https://*.example.com, default *
+	AllowMethods     []string `yaml:"allow-methods"`
+	AllowHeaders     []string `yaml:"allow-headers"` // default allow all request headers
+	ExposeHeaders    []string `yaml:"expose-headers"`
+	AllowCredentials bool     `yaml:"allow-credentials"`
+	MaxAge           int      `yaml:"max-age"` // seconds
+}
+
+type CORSOverride struct {
+	Prefix   string `yaml:"prefix"`
+	CORSRule `yaml:",inline"`
+}
+
+// CORSConfig can be written as "cors: true" or a map with the rule fields
+type CORSConfig struct {
+	Enabled   bool `yaml:"enabled"`
+	CORSRule  `yaml:",inline"`
+	Overrides []CORSOverride `yaml:"overrides"` // rule of the longest matched prefix replaces the default one
+}
+
+func (c *CORSConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		*c = CORSConfig{Enabled: enabled}
+		return nil
+	}
+	type plain CORSConfig
+	cfg := plain{Enabled: true}
+	if err := unmarshal(&cfg); err != nil {
+		return err
+	}
+	*c = CORSConfig(cfg)
+	return nil
+}
+
+// rule returns the rule for url path
+func (c *CORSConfig) rule(urlPath string) *CORSRule {
+	rule, matched := &c.CORSRule, ""
+	for i, o := range c.Overrides {
+		prefix := gcfg.Prefix + "/" + strings.Trim(o.Prefix, "/")
+		if (urlPath == prefix || strings.HasPrefix(urlPath, strings.TrimSuffix(prefix, "/")+"/")) && len(prefix) > len(matched) {
+			rule, matched = &c.Overrides[i].CORSRule, prefix
+		}
+	}
+	return rule
+}
+
+// allowOrigin returns value of Access-Control-Allow-Origin, empty if not allowed
+func (rule *CORSRule) allowOrigin(origin string) string {
+	origins := rule.AllowOrigins
+	if len(origins) == 0 {
+		origins = []string{"*"}
+	}
+	for _, pattern := range origins {
+		if pattern == "*" {
+			if rule.AllowCredentials && origin != "" { // * is not allowed with credentials
+				return origin
+			}
+			return "*"
+		}
+		if origin == "" {
+			continue
+		}
+		if strings.EqualFold(pattern, origin) {
+			return origin
+		}
+		if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(origin)); matched {
+			return origin
+		}
+	}
+	return ""
+}
+
+func cors(cfg CORSConfig, next http.Handler) http.Handler {
+	// access control and CORS middleware
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rule := cfg.rule(r.URL.Path)
+		allowOrigin := rule.allowOrigin(r.Header.Get("Origin"))
+		if allowOrigin != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+		if allowOrigin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			if rule.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if len(rule.ExposeHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(rule.ExposeHeaders, ", "))
+			}
+		}
+		if r.Method != "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// preflight request
+		if allowOrigin != "" {
+			methods := rule.AllowMethods
+			if len(methods) == 0 {
+				methods = defaultCORSMethods
+			}
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			if len(rule.AllowHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(rule.AllowHeaders, ", "))
+			} else if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+				w.Header().Set("Access-Control-Allow-Headers", reqHeaders)
+			}
+			if rule.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(rule.MaxAge))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-yaml/yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORS(t *testing.T) {
+	var cfg struct {
+		CORS CORSConfig `yaml:"cors"`
+	}
+	assert.NoError(t, yaml.Unmarshal([]byte("cors: true"), &cfg))
+	assert.True(t, cfg.CORS.Enabled)
+
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+cors:
+  allow-origins: ["https://*.example.com"]
+  allow-methods: [GET]
+  max-age: 60
+  overrides:
+  - prefix: /public
+    allow-origins: ["*"]
+`), &cfg))
+	assert.True(t, cfg.CORS.Enabled)
+
+	hdlr := cors(cfg.CORS, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(method, url, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		hdlr.ServeHTTP(w, r)
+		return w
+	}
+	w := do("GET", "/a.txt", "https://dash.example.com")
+	assert.Equal(t, "https://dash.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+
+	w = do("GET", "/a.txt", "https://evil.com")
+	assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = do("OPTIONS", "/a.txt", "https://dash.example.com")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "GET", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "60", w.Header().Get("Access-Control-Max-Age"))
+
+	w = do("GET", "/public/a.txt", "https://evil.com")
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+
+	assert.NoError(t, yaml.Unmarshal([]byte("cors: false"), &cfg))
+	w = httptest.NewRecorder()
+	cors(cfg.CORS, http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+}
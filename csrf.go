@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+const (
+	csrfCookieName = "ghs-csrf"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfFormName   = "_csrf"
+)
+
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// needCSRFCheck returns true for requests which might be sent by a browser on behalf of the user:
+// requests with the session cookie, or with Origin/Sec-Fetch-Site headers that only browsers send.
+// Requests authenticated by api token are handled before and never come here.
+func needCSRFCheck(r *http.Request) bool {
+	if _, err := r.Cookie(defaultSessionName); err == nil {
+		return true
+	}
+	return r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != ""
+}
+
+// csrfProtect implements the double submit cookie pattern. A random token is stored in cookie ghs-csrf,
+// state-changing requests must send the same value with header X-CSRF-Token or form field _csrf.
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(csrfCookieName)
+		if err != nil || cookie.Value == "" {
+			cookie = &http.Cookie{
+				Name:     csrfCookieName,
+				Value:    randomHex(16),
+				Path:     "/",
+				SameSite: http.SameSiteLaxMode,
+			}
+			http.SetCookie(w, cookie)
+		}
+		if isSafeMethod(r.Method) || requestToken(r) != nil || !needCSRFCheck(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := r.Header.Get(csrfHeaderName)
+		if token == "" {
+			token = r.FormValue(csrfFormName)
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+			http.Error(w, "CSRF token missing or invalid", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
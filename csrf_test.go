@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	hdlr := csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	do := func(method string, header map[string]string) int {
+		req := httptest.NewRequest(method, "/foo", nil)
+		req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "abc"})
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		hdlr.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, 200, do("GET", map[string]string{"Origin": "http://evil.com"}))
+	assert.Equal(t, 200, do("POST", nil)) // not from browser, eg: curl
+	assert.Equal(t, 403, do("POST", map[string]string{"Origin": "http://evil.com"}))
+	assert.Equal(t, 403, do("DELETE", map[string]string{"Origin": "http://localhost", csrfHeaderName: "xyz"}))
+	assert.Equal(t, 200, do("DELETE", map[string]string{"Origin": "http://localhost", csrfHeaderName: "abc"}))
+}
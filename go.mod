@@ -17,10 +17,14 @@ require (
 	github.com/gorilla/mux v1.6.2
 	github.com/gorilla/sessions v1.2.0
 	github.com/pkg/errors v0.8.0 // indirect
+	github.com/pkg/sftp v1.13.6
 	github.com/shogo82148/androidbinary v0.0.0-20180627093851-01c4bfa8b3b5
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/stretchr/testify v1.3.0
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.36.0
 	golang.org/x/net v0.38.0 // indirect
 	golang.org/x/text v0.23.0
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
 	howett.net/plist v0.0.0-20201203080718-1454fab16a06 // indirect
 )
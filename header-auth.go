@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HeaderAuth reads user from request headers set by a trusted reverse proxy, eg: oauth2-proxy.
+// Headers from other addresses are removed so that clients can not spoof them.
+type HeaderAuth struct {
+	EmailHeader  string
+	UserHeader   string
+	NameHeader   string
+	GroupsHeader string
+	trusted      []*net.IPNet
+}
+
+var defaultTrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+
+func NewHeaderAuth(trustedProxies []string) (*HeaderAuth, error) {
+	h := &HeaderAuth{
+		EmailHeader:  "X-Auth-Request-Email",
+		UserHeader:   "X-Auth-Request-User",
+		NameHeader:   "X-Auth-Request-Fullname",
+		GroupsHeader: "X-Auth-Request-Groups",
+	}
+	if len(trustedProxies) == 0 {
+		trustedProxies = defaultTrustedProxies
+	}
+	for _, cidr := range trustedProxies {
+		if !strings.Contains(cidr, "/") { // single ip
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %v", err)
+		}
+		h.trusted = append(h.trusted, ipnet)
+	}
+	return h, nil
+}
+
+func (h *HeaderAuth) isTrusted(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range h.trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HeaderAuth) headers() []string {
+	return []string{h.EmailHeader, h.UserHeader, h.NameHeader, h.GroupsHeader}
+}
+
+func (h *HeaderAuth) user(r *http.Request) *UserInfo {
+	email := r.Header.Get(h.EmailHeader)
+	if email == "" {
+		return nil
+	}
+	// oauth2-proxy send fullname urlencoded
+	name := r.Header.Get(h.NameHeader)
+	if unescaped, err := url.QueryUnescape(name); err == nil {
+		name = unescaped
+	}
+	user := &UserInfo{
+		Id:       email,
+		Email:    email,
+		Name:     name,
+		NickName: r.Header.Get(h.UserHeader),
+	}
+	for _, group := range strings.Split(r.Header.Get(h.GroupsHeader), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			user.Groups = append(user.Groups, group)
+		}
+	}
+	return user
+}
+
+// Middleware must be the outermost handler, before X-Forwarded-For rewrites the remote address
+func (h *HeaderAuth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.isTrusted(r.RemoteAddr) {
+			for _, name := range h.headers() {
+				if r.Header.Get(name) != "" {
+					log.Printf("Ignore header %s from untrusted address %s", name, r.RemoteAddr)
+					r.Header.Del(name)
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if user := h.user(r); user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), ctxKeyProxyUser, user))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// proxyUser returns user set by HeaderAuth.Middleware
+func proxyUser(r *http.Request) *UserInfo {
+	user, _ := r.Context().Value(ctxKeyProxyUser).(*UserInfo)
+	return user
+}
+
+func handleHeaderAuth() {
+	http.HandleFunc("/-/user", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		data, _ := json.Marshal(proxyUser(r))
+		w.Write(data)
+	})
+}
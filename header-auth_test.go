@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCurrentUserIgnoresSessionWithProxyAuth(t *testing.T) {
+	// a session cookie made by a client which bypasses the proxy
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	session, _ := store.Get(r, defaultSessionName)
+	session.Values["user"] = &UserInfo{Email: "admin@example.com"}
+	assert.Nil(t, session.Save(r, w))
+	forged := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		forged.AddCookie(c)
+	}
+
+	defer func(authType string) { gcfg.Auth.Type = authType }(gcfg.Auth.Type)
+	for authType, email := range map[string]string{
+		"openid":       "admin@example.com",
+		"header":       "",
+		"oauth2-proxy": "",
+		"http":         "",
+		"":             "",
+	} {
+		gcfg.Auth.Type = authType
+		user := currentUser(forged)
+		if email == "" {
+			assert.Nil(t, user, authType)
+		} else if assert.NotNil(t, user, authType) {
+			assert.Equal(t, email, user.Email)
+		}
+	}
+}
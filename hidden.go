@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	dkignore "github.com/codeskyblue/dockerignore"
+)
+
+// IGNOREFILE lists files hidden in the directory and below, gitignore style
+const IGNOREFILE = ".ghsignore"
+
+// HiddenConf hides files from listing, search, archive and download for everyone
+type HiddenConf struct {
+	Dotfiles bool     `yaml:"dotfiles"` // hide files and directories whose name starts with .
+	Patterns []string `yaml:"patterns"` // gitignore style, eg: node_modules, *.bak, !.well-known
+}
+
+// ignoreRule is a pattern of hidden files, relative to base
+type ignoreRule struct {
+	base     string // directory of the .ghsignore, relative to root
+	pattern  string // pattern of dockerignore
+	anywhere bool   // pattern without slash, matches the name in all directories
+	negative bool   // !pattern, shows files again
+}
+
+// newIgnoreRule converts a gitignore style pattern of the directory base
+func newIgnoreRule(base, pattern string) ignoreRule {
+	rule := ignoreRule{base: base, negative: strings.HasPrefix(pattern, "!")}
+	pattern = strings.TrimPrefix(pattern, "!")
+	rule.anywhere = !strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+	rule.pattern = strings.TrimPrefix(pattern, "/")
+	return rule
+}
+
+// match reports whether relPath (relative to root with leading /) matches the rule
+func (rule ignoreRule) match(relPath string) bool {
+	base := strings.TrimSuffix(rule.base, "/") + "/"
+	if !strings.HasPrefix(relPath, base) {
+		return false
+	}
+	name := relPath[len(base):]
+	if rule.anywhere {
+		name = path.Base(name)
+	}
+	matched, _ := dkignore.Matches(name, []string{rule.pattern})
+	return matched
+}
+
+// parseIgnore returns the valid patterns of a .ghsignore and the errors of the others,
+// empty lines and comments are skipped
+func parseIgnore(data []byte) ([]string, error) {
+	lines, err := dkignore.ReadIgnore(ioutil.NopCloser(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	var errs ConfigErrors
+	for _, pattern := range lines {
+		if err := checkIgnorePattern(pattern); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	if len(errs) > 0 {
+		return patterns, errs
+	}
+	return patterns, nil
+}
+
+// checkIgnorePattern returns an error if pattern is not a valid gitignore style pattern
+func checkIgnorePattern(pattern string) error {
+	if pattern == "" || pattern == "!" {
+		return fmt.Errorf("empty pattern %s", strconv.Quote(pattern))
+	}
+	_, err := dkignore.Matches("x", []string{newIgnoreRule("/", pattern).pattern})
+	return err
+}
+
+// ignoreRules converts patterns of the directory base to rules
+func ignoreRules(base string, patterns []string) []ignoreRule {
+	rules := make([]ignoreRule, 0, len(patterns))
+	for _, pattern := range patterns {
+		rules = append(rules, newIgnoreRule(base, pattern))
+	}
+	return rules
+}
+
+// hiddenRules returns the rules of the server config for root or a mount at base
+func (s *HTTPStaticServer) hiddenRules(base string) []ignoreRule {
+	patterns := s.Hidden.Patterns
+	if s.Hidden.Dotfiles {
+		patterns = append([]string{".*"}, patterns...)
+	}
+	return ignoreRules(base, patterns)
+}
+
+// hidden reports whether relPath or one of its parents is hidden. Later rules win, so a
+// .ghsignore can show files hidden by its parents with !pattern. .ghs.yml is never hidden
+// and .ghsignore always is.
+func (c *AccessConf) hidden(relPath string) bool {
+	relPath = path.Clean("/" + relPath)
+	switch path.Base(relPath) {
+	case YAMLCONF:
+		relPath = path.Dir(relPath)
+	case IGNOREFILE:
+		return true
+	}
+	if len(c.ignores) == 0 || relPath == "/" {
+		return false
+	}
+	elems := strings.Split(relPath[1:], "/")
+	for i := range elems {
+		p := "/" + strings.Join(elems[:i+1], "/")
+		matched := false
+		for _, rule := range c.ignores {
+			if rule.match(p) {
+				matched = !rule.negative
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHiddenFiles(t *testing.T) {
+	root := t.TempDir()
+	for name, data := range map[string]string{
+		".env":                 "SECRET=1",
+		".git/config":          "[core]",
+		".well-known/security": "contact",
+		"a.bak":                "a",
+		"a.txt":                "a",
+		"docs/b.txt":           "b",
+		"docs/keep.bak":        "keep",
+		"docs/secret/s.txt":    "s",
+		"docs/" + IGNOREFILE:   "# hidden in docs\nsecret\n!keep.bak\n",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755)
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(root, name), []byte(data), 0644))
+	}
+	s := NewHTTPStaticServer(root, true)
+	s.Hidden = HiddenConf{Dotfiles: true, Patterns: []string{"*.bak", "!.well-known"}}
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+	list := func(url string) []string {
+		var data struct {
+			Files []HTTPFileInfo `json:"files"`
+		}
+		assert.Nil(t, json.Unmarshal(get(url).Body.Bytes(), &data))
+		var paths []string
+		for _, f := range data.Files {
+			paths = append(paths, filepath.ToSlash(f.Path))
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	assert.Equal(t, []string{".well-known", "a.txt", "docs"}, list("/?json=true"))
+	assert.Equal(t, []string{"docs/b.txt", "docs/keep.bak"}, list("/docs?json=true"))
+	for url, status := range map[string]int{
+		"/.env":                 http.StatusNotFound,
+		"/.git/config":          http.StatusNotFound,
+		"/.git":                 http.StatusNotFound,
+		"/a.bak":                http.StatusNotFound,
+		"/docs/secret/s.txt":    http.StatusNotFound,
+		"/docs/" + IGNOREFILE:   http.StatusNotFound,
+		"/.well-known/security": http.StatusOK,
+		"/docs/keep.bak":        http.StatusOK,
+		"/a.txt":                http.StatusOK,
+	} {
+		assert.Equal(t, status, get(url).Code, url)
+	}
+
+	assert.Nil(t, s.makeIndex())
+	var indexed []string
+	for _, item := range s.indexes {
+		indexed = append(indexed, item.Path)
+	}
+	sort.Strings(indexed)
+	assert.Equal(t, []string{".well-known/security", "a.txt", "docs/b.txt", "docs/keep.bak"}, indexed)
+	assert.Equal(t, []string{"docs/b.txt"}, list("/?json=true&search=b.txt"))
+
+	body := get("/?op=archive").Body.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	assert.Nil(t, err)
+	var archived []string
+	for _, f := range zr.File {
+		if !f.FileInfo().IsDir() {
+			archived = append(archived, f.Name)
+		}
+	}
+	sort.Strings(archived)
+	assert.Equal(t, []string{".well-known/security", "a.txt", "docs/b.txt", "docs/keep.bak"}, archived)
+}
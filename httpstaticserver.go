@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,15 +15,14 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"regexp"
-
-	"github.com/go-yaml/yaml"
 	"github.com/gorilla/mux"
 	"github.com/shogo82148/androidbinary/apk"
 )
@@ -59,10 +60,21 @@ type HTTPStaticServer struct {
 	AuthType         string
 	DeepPathMaxDepth int
 	NoIndex          bool
+	Tokens           *TokenStore
+	Shares           *ShareStore
+	Audit            *AuditLog
+	Stats            *StatsStore
+	Limiter          *RateLimiter
+	Mounts           []Mount
+	Storage          Storage // local filesystem if nil
+	Symlinks         string  // symlink policy of the local filesystem, follow-within-root if empty
+	Hidden           HiddenConf
 
 	indexes []IndexFileItem
+	acl     accessCache
 	m       *mux.Router
-	bufPool sync.Pool // use sync.Pool caching buf to reduce gc ratio
+	bufPool sync.Pool    // use sync.Pool caching buf to reduce gc ratio
+	mu      sync.RWMutex // guards Upload, Delete, Title, Theme, GoogleTrackerID and Limiter which are changed by config reload
 }
 
 func NewHTTPStaticServer(root string, noIndex bool) *HTTPStaticServer {
@@ -76,6 +88,7 @@ func NewHTTPStaticServer(root string, noIndex bool) *HTTPStaticServer {
 	}
 	log.Printf("root path: %s\n", root)
 	m := mux.NewRouter()
+	shares, _ := OpenShareStore("") // keep share links in memory by default
 	s := &HTTPStaticServer{
 		Root:  root,
 		Theme: "black",
@@ -84,6 +97,7 @@ func NewHTTPStaticServer(root string, noIndex bool) *HTTPStaticServer {
 			New: func() interface{} { return make([]byte, 32*1024) },
 		},
 		NoIndex: noIndex,
+		Shares:  shares,
 	}
 
 	if !noIndex {
@@ -93,6 +107,7 @@ func NewHTTPStaticServer(root string, noIndex bool) *HTTPStaticServer {
 				startTime := time.Now()
 				log.Println("Started making search index")
 				s.makeIndex()
+				metrics.setIndex(len(s.indexes), time.Since(startTime))
 				log.Printf("Completed search index in %v", time.Since(startTime))
 				//time.Sleep(time.Second * 1)
 				time.Sleep(time.Minute * 10)
@@ -104,6 +119,14 @@ func NewHTTPStaticServer(root string, noIndex bool) *HTTPStaticServer {
 	m.HandleFunc("/-/ipa/plist/{path:.*}", s.hPlist)
 	m.HandleFunc("/-/ipa/link/{path:.*}", s.hIpaLink)
 	m.HandleFunc("/-/video-player/{path:.*}", s.hVideoPlayer)
+	m.HandleFunc("/-/tokens", s.hTokens).Methods("GET", "POST")
+	m.HandleFunc("/-/tokens/{id}", s.hTokenRevoke).Methods("DELETE")
+	m.HandleFunc("/-/share", s.hShare).Methods("GET", "POST")
+	m.HandleFunc("/-/share/{id}", s.hShareRevoke).Methods("DELETE")
+	m.HandleFunc("/-/audit", s.hAudit).Methods("GET")
+	m.HandleFunc("/-/stats", s.hStats).Methods("GET")
+	m.HandleFunc("/-/debug/acl", s.hDebugACL).Methods("GET")
+	m.HandleFunc("/-/metrics", s.hMetrics).Methods("GET")
 
 	m.HandleFunc("/{path:.*}", s.hIndex).Methods("GET", "HEAD")
 	m.HandleFunc("/{path:.*}", s.hUploadOrMkdir).Methods("POST")
@@ -115,6 +138,18 @@ func (s *HTTPStaticServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.m.ServeHTTP(w, r)
 }
 
+func (s *HTTPStaticServer) title() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Title
+}
+
+func (s *HTTPStaticServer) limiter() *RateLimiter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Limiter
+}
+
 // Return real path with Seperator(/)
 func (s *HTTPStaticServer) getRealPath(r *http.Request) string {
 	path := mux.Vars(r)["path"]
@@ -126,8 +161,7 @@ func (s *HTTPStaticServer) getRealPath(r *http.Request) string {
 	if err != nil {
 		relativePath = path
 	}
-	realPath := filepath.Join(s.Root, relativePath)
-	return filepath.ToSlash(realPath)
+	return s.realPathOf(relativePath)
 }
 
 func (s *HTTPStaticServer) hIndex(w http.ResponseWriter, r *http.Request) {
@@ -149,14 +183,46 @@ func (s *HTTPStaticServer) hIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Println("GET", path, realPath)
-	if r.FormValue("raw") == "false" || isDir(realPath) {
+	auth := s.readAccessConf(realPath)
+	if isDir := s.isDir(realPath); r.FormValue("raw") == "false" || isDir {
+		if isDir && !auth.canList(r) {
+			s.deny(w, r, &auth, AuditList)
+			return
+		}
+		page := indexPage{HTTPStaticServer: s}
+		if isDir {
+			setMetricsHandler(r, "index")
+			// the web UI is the default, machine clients can ask for json or plain text
+			w.Header().Add("Vary", "Accept")
+			switch negotiate(r.Header.Get("Accept"), "text/html", "application/json", "text/plain") {
+			case "application/json":
+				s.hJSONList(w, r)
+				return
+			case "text/plain":
+				s.hTextList(w, r, realPath, &auth)
+				return
+			}
+		}
 		if r.Method == "HEAD" {
 			return
 		}
-		renderHTML(w, "assets/index.html", s)
+		if isDir { // listed in <noscript> for browsers without javascript and wget -r
+			page.Path = "/" + strings.Trim(path, "/")
+			if s.relativePath(realPath) != "/" {
+				page.Parent = strings.TrimSuffix(filepath.ToSlash(filepath.Dir(page.Path)), "/") + "/"
+			}
+			page.Files, _ = s.listFiles(r, path, realPath, &auth)
+			sortListing(page.Files)
+		}
+		s.mu.RLock()
+		renderHTML(w, "assets/index.html", page)
+		s.mu.RUnlock()
 	} else {
+		if !auth.canRead(r) {
+			s.deny(w, r, &auth, AuditRead)
+			return
+		}
 		if filepath.Base(path) == YAMLCONF {
-			auth := s.readAccessConf(realPath)
 			if !auth.Delete {
 				http.Error(w, "Security warning, not allowed to read", http.StatusForbidden)
 				return
@@ -165,8 +231,54 @@ func (s *HTTPStaticServer) hIndex(w http.ResponseWriter, r *http.Request) {
 		if r.FormValue("download") == "true" {
 			w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filepath.Base(path)))
 		}
-		http.ServeFile(w, r, realPath)
+		s.serveFile(w, r, realPath)
+	}
+}
+
+// serveFile serves file within the download limits, it is counted when the whole file is sent
+func (s *HTTPStaticServer) serveFile(w http.ResponseWriter, r *http.Request, realPath string) {
+	limiter := s.limiter()
+	release, ok := limiter.acquireDownload(r)
+	if !ok {
+		tooManyRequests(w, time.Second, "Too many downloads in progress")
+		return
+	}
+	defer release()
+	w = limiter.throttle(w, r)
+	if s.Stats == nil || r.Method != "GET" || r.Header.Get("Range") != "" {
+		s.serveContent(w, r, realPath)
+		return
+	}
+	sw := &statusRecorder{ResponseWriter: w}
+	s.serveContent(sw, r, realPath)
+	if sw.status == http.StatusOK && sw.err == nil {
+		if err := s.Stats.Count(s.relativePath(realPath)); err != nil {
+			log.Println("Count download:", err)
+		}
+	}
+}
+
+// serveContent serves a file of the storage, Range and conditional requests are handled by http.ServeContent
+func (s *HTTPStaticServer) serveContent(w http.ResponseWriter, r *http.Request, realPath string) {
+	f, err := s.fs().Open(realPath)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			http.Error(w, "404 page not found", http.StatusNotFound)
+		case os.IsPermission(err):
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+		default:
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
 	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
 }
 
 func (s *HTTPStaticServer) hDelete(w http.ResponseWriter, req *http.Request) {
@@ -174,13 +286,21 @@ func (s *HTTPStaticServer) hDelete(w http.ResponseWriter, req *http.Request) {
 	realPath := s.getRealPath(req)
 	// path = filepath.Clean(path) // for safe reason, prevent path contain ..
 	auth := s.readAccessConf(realPath)
-	if !auth.canDelete(req) {
+	// root and mount points can not be removed, symlinks are checked by the storage
+	entry := newAuditEntry(req, &auth, AuditDelete, auth.canDelete(req) && auth.path != "/" && !s.isMountPoint(auth.path))
+	if !entry.Allowed {
+		s.Audit.Log(entry)
 		http.Error(w, "Delete forbidden", http.StatusForbidden)
 		return
 	}
 
-	// TODO: path safe check
-	err := os.RemoveAll(realPath)
+	err := s.fs().RemoveAll(realPath)
+	if err != nil {
+		entry.Error = err.Error()
+	} else if err := s.Stats.Remove(s.relativePath(realPath)); err != nil {
+		log.Println("Remove download stats:", err)
+	}
+	s.Audit.Log(entry)
 	if err != nil {
 		pathErr, ok := err.(*os.PathError)
 		if ok {
@@ -198,15 +318,30 @@ func (s *HTTPStaticServer) hUploadOrMkdir(w http.ResponseWriter, req *http.Reque
 
 	// check auth
 	auth := s.readAccessConf(dirpath)
-	if !auth.canUpload(req) {
+	allowed := auth.canUpload(req)
+	file, header, err := req.FormFile("file")
+	op := AuditUpload
+	if file == nil {
+		op = AuditMkdir
+	} else if req.FormValue("unzip") == "true" {
+		op = AuditUnzip
+	}
+	entry := newAuditEntry(req, &auth, op, allowed)
+	if header != nil {
+		entry.Path = path.Join(auth.path, header.Filename)
+	}
+	if !allowed {
+		s.Audit.Log(entry)
+		if file != nil {
+			file.Close()
+			req.MultipartForm.RemoveAll()
+		}
 		http.Error(w, "Upload forbidden", http.StatusForbidden)
 		return
 	}
 
-	file, header, err := req.FormFile("file")
-
-	if _, err := os.Stat(dirpath); os.IsNotExist(err) {
-		if err := os.MkdirAll(dirpath, os.ModePerm); err != nil {
+	if _, err := s.fs().Stat(dirpath); os.IsNotExist(err) {
+		if err := s.fs().MkdirAll(dirpath); err != nil {
 			log.Println("Create directory:", err)
 			http.Error(w, "Directory create "+err.Error(), http.StatusInternalServerError)
 			return
@@ -214,6 +349,7 @@ func (s *HTTPStaticServer) hUploadOrMkdir(w http.ResponseWriter, req *http.Reque
 	}
 
 	if file == nil { // only mkdir
+		s.Audit.Log(entry)
 		w.Header().Set("Content-Type", "application/json;charset=utf-8")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success":     true,
@@ -242,6 +378,14 @@ func (s *HTTPStaticServer) hUploadOrMkdir(w http.ResponseWriter, req *http.Reque
 	}
 
 	dstPath := filepath.Join(dirpath, filename)
+	entry.Path = path.Join(auth.path, filename)
+	if !auth.writable(req, entry.Path) {
+		entry.Allowed = false
+		entry.Rule = "accessTables"
+		s.Audit.Log(entry)
+		http.Error(w, "Upload forbidden", http.StatusForbidden)
+		return
+	}
 
 	// Large file (>32MB) will store in tmp directory
 	// The quickest operation is call os.Move instead of os.Copy
@@ -254,7 +398,7 @@ func (s *HTTPStaticServer) hUploadOrMkdir(w http.ResponseWriter, req *http.Reque
 	// 	log.Printf("Move %s -> %s", tmpUploadPath, dstPath)
 	// 	copyErr = os.Rename(tmpUploadPath, dstPath)
 	// } else {
-	dst, err := os.Create(dstPath)
+	dst, err := s.fs().Create(dstPath, false)
 	if err != nil {
 		log.Println("Create file:", err)
 		http.Error(w, "File create "+err.Error(), http.StatusInternalServerError)
@@ -265,24 +409,36 @@ func (s *HTTPStaticServer) hUploadOrMkdir(w http.ResponseWriter, req *http.Reque
 	// _, copyErr = io.Copy(dst, file)
 	buf := s.bufPool.Get().([]byte)
 	defer s.bufPool.Put(buf)
-	_, copyErr = io.CopyBuffer(dst, file, buf)
-	dst.Close()
+	hash := sha256.New()
+	entry.Size, copyErr = io.CopyBuffer(io.MultiWriter(dst, hash), file, buf)
+	if err := dst.Close(); copyErr == nil {
+		copyErr = err
+	}
 	// }
+	entry.Digest = "sha256:" + hex.EncodeToString(hash.Sum(nil))
 	if copyErr != nil {
-		log.Println("Handle upload file:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		entry.Error = copyErr.Error()
+		s.Audit.Log(entry)
+		log.Println("Handle upload file:", copyErr)
+		http.Error(w, copyErr.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 
 	if req.FormValue("unzip") == "true" {
-		err = unzipFile(dstPath, dirpath)
-		os.Remove(dstPath)
+		// entries are checked like files uploaded one by one
+		err = unzipFile(s.fs(), dstPath, dirpath, func(fpath string) bool {
+			dirAuth := s.readAccessConf(filepath.Dir(fpath))
+			return dirAuth.canUpload(req) && dirAuth.writable(req, s.relativePath(fpath))
+		})
+		s.fs().RemoveAll(dstPath)
 		message := "success"
 		if err != nil {
 			message = err.Error()
+			entry.Error = message
 		}
+		s.Audit.Log(entry)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success":     err == nil,
 			"description": message,
@@ -290,6 +446,7 @@ func (s *HTTPStaticServer) hUploadOrMkdir(w http.ResponseWriter, req *http.Reque
 		return
 	}
 
+	s.Audit.Log(entry)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":     true,
 		"destination": dstPath,
@@ -297,22 +454,28 @@ func (s *HTTPStaticServer) hUploadOrMkdir(w http.ResponseWriter, req *http.Reque
 }
 
 type FileJSONInfo struct {
-	Name    string      `json:"name"`
-	Type    string      `json:"type"`
-	Size    int64       `json:"size"`
-	Path    string      `json:"path"`
-	ModTime int64       `json:"mtime"`
-	Extra   interface{} `json:"extra,omitempty"`
+	Name      string      `json:"name"`
+	Type      string      `json:"type"`
+	Size      int64       `json:"size"`
+	Path      string      `json:"path"`
+	ModTime   int64       `json:"mtime"`
+	Downloads uint64      `json:"downloads"`
+	Extra     interface{} `json:"extra,omitempty"`
 }
 
 // path should be absolute
-func parseApkInfo(path string) (ai *ApkInfo) {
+func parseApkInfo(fs Storage, path string) (ai *ApkInfo) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println("parse-apk-info panic:", err)
 		}
 	}()
-	apkf, err := apk.OpenFile(path)
+	f, size, err := openSized(fs, path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	apkf, err := apk.OpenZipReader(f, size)
 	if err != nil {
 		return
 	}
@@ -327,17 +490,23 @@ func parseApkInfo(path string) (ai *ApkInfo) {
 func (s *HTTPStaticServer) hInfo(w http.ResponseWriter, r *http.Request) {
 	path := mux.Vars(r)["path"]
 	relPath := s.getRealPath(r)
+	auth := s.readAccessConf(relPath)
+	if !auth.canRead(r) {
+		s.deny(w, r, &auth, AuditRead)
+		return
+	}
 
-	fi, err := os.Stat(relPath)
+	fi, err := s.fs().Stat(relPath)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	fji := &FileJSONInfo{
-		Name:    fi.Name(),
-		Size:    fi.Size(),
-		Path:    path,
-		ModTime: fi.ModTime().UnixNano() / 1e6,
+		Name:      fi.Name(),
+		Size:      fi.Size(),
+		Path:      path,
+		ModTime:   fi.ModTime().UnixNano() / 1e6,
+		Downloads: s.Stats.Get(s.relativePath(relPath)),
 	}
 	ext := filepath.Ext(path)
 	switch ext {
@@ -345,7 +514,7 @@ func (s *HTTPStaticServer) hInfo(w http.ResponseWriter, r *http.Request) {
 		fji.Type = "markdown"
 	case ".apk":
 		fji.Type = "apk"
-		fji.Extra = parseApkInfo(relPath)
+		fji.Extra = parseApkInfo(s.fs(), relPath)
 	case "":
 		fji.Type = "dir"
 	default:
@@ -353,11 +522,31 @@ func (s *HTTPStaticServer) hInfo(w http.ResponseWriter, r *http.Request) {
 	}
 	data, _ := json.Marshal(fji)
 	w.Header().Set("Content-Type", "application/json")
+	if r.Method == "HEAD" {
+		return
+	}
 	w.Write(data)
 }
 
 func (s *HTTPStaticServer) hZip(w http.ResponseWriter, r *http.Request) {
-	CompressToZip(w, s.getRealPath(r))
+	realPath := s.getRealPath(r)
+	auth := s.readAccessConf(realPath)
+	if !auth.canRead(r) {
+		s.deny(w, r, &auth, AuditRead)
+		return
+	}
+	limiter := s.limiter()
+	release, ok := limiter.acquireDownload(r)
+	if !ok {
+		tooManyRequests(w, time.Second, "Too many downloads in progress")
+		return
+	}
+	defer release()
+	CompressToZip(limiter.throttle(w, r), s.fs(), realPath, func(path string, info os.FileInfo) bool {
+		pathAuth := s.readAccessConf(path)
+		dirAuth := s.readAccessConf(filepath.Dir(path))
+		return pathAuth.canRead(r) && dirAuth.visible(r, s.relativePath(path))
+	})
 }
 
 func (s *HTTPStaticServer) hUnzip(w http.ResponseWriter, r *http.Request) {
@@ -367,7 +556,7 @@ func (s *HTTPStaticServer) hUnzip(w http.ResponseWriter, r *http.Request) {
 	if ctype != "" {
 		w.Header().Set("Content-Type", ctype)
 	}
-	err := ExtractFromZip(filepath.Join(s.Root, zipPath), path, w)
+	err := ExtractFromZip(s.fs(), s.realPathOf(zipPath), path, w)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -390,7 +579,12 @@ func (s *HTTPStaticServer) hPlist(w http.ResponseWriter, r *http.Request) {
 	}
 
 	relPath := s.getRealPath(r)
-	plinfo, err := parseIPA(relPath)
+	auth := s.readAccessConf(relPath)
+	if !auth.canRead(r) {
+		s.deny(w, r, &auth, AuditRead)
+		return
+	}
+	plinfo, err := parseIPA(s.fs(), relPath)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -469,114 +663,95 @@ func (s *HTTPStaticServer) genPlistLink(httpPlistLink string) (plistUrl string,
 }
 
 func (s *HTTPStaticServer) hFileOrDirectory(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, s.getRealPath(r))
-}
-
-type HTTPFileInfo struct {
-	Name    string `json:"name"`
-	Path    string `json:"path"`
-	Type    string `json:"type"`
-	Size    int64  `json:"size"`
-	ModTime int64  `json:"mtime"`
+	s.serveContent(w, r, s.getRealPath(r))
 }
 
-type AccessTable struct {
-	Regex string `yaml:"regex"`
-	Allow bool   `yaml:"allow"`
+// indexPage is the data of index.html, Files of a directory are rendered for browsers without javascript
+type indexPage struct {
+	*HTTPStaticServer
+	Path   string // url path of the directory, empty for the preview of a file
+	Parent string // url path of the parent directory, empty for root
+	Files  []HTTPFileInfo
 }
 
-type UserControl struct {
-	Email string
-	// Access bool
-	Upload bool
-	Delete bool
-	Token  string
-}
-
-type AccessConf struct {
-	Upload       bool          `yaml:"upload" json:"upload"`
-	Delete       bool          `yaml:"delete" json:"delete"`
-	Users        []UserControl `yaml:"users" json:"users"`
-	AccessTables []AccessTable `yaml:"accessTables"`
+type HTTPFileInfo struct {
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Type      string `json:"type"`
+	Size      int64  `json:"size"`
+	ModTime   int64  `json:"mtime"`
+	Downloads uint64 `json:"downloads"`
+	Symlink   bool   `json:"symlink,omitempty"`
 }
 
-var reCache = make(map[string]*regexp.Regexp)
-
-func (c *AccessConf) canAccess(fileName string) bool {
-	for _, table := range c.AccessTables {
-		pattern, ok := reCache[table.Regex]
-		if !ok {
-			pattern, _ = regexp.Compile(table.Regex)
-			reCache[table.Regex] = pattern
-		}
-		// skip wrong format regex
-		if pattern == nil {
-			continue
-		}
-		if pattern.MatchString(fileName) {
-			return table.Allow
-		}
+func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
+	requestPath := mux.Vars(r)["path"]
+	realPath := s.getRealPath(r)
+	auth := s.readAccessConf(realPath)
+	if !auth.canList(r) {
+		s.deny(w, r, &auth, AuditList)
+		return
 	}
-	return true
-}
-
-func (c *AccessConf) canDelete(r *http.Request) bool {
-	session, err := store.Get(r, defaultSessionName)
+	lrs, err := s.listFiles(r, requestPath, realPath, &auth)
 	if err != nil {
-		return c.Delete
-	}
-	val := session.Values["user"]
-	if val == nil {
-		return c.Delete
+		http.Error(w, err.Error(), 500)
+		return
 	}
-	userInfo := val.(*UserInfo)
-	for _, rule := range c.Users {
-		if rule.Email == userInfo.Email {
-			return rule.Delete
-		}
+	if r.FormValue("sort") == "downloads" {
+		sort.SliceStable(lrs, func(i, j int) bool {
+			return lrs[i].Downloads > lrs[j].Downloads
+		})
 	}
-	return c.Delete
-}
+	auth.Read = auth.canRead(r)
+	auth.List = true
+	auth.Upload = auth.canUpload(r)
+	auth.Delete = auth.canDelete(r)
 
-func (c *AccessConf) canUploadByToken(token string) bool {
-	for _, rule := range c.Users {
-		if rule.Token == token {
-			return rule.Upload
-		}
+	data, _ := json.Marshal(map[string]interface{}{
+		"files": lrs,
+		"auth":  auth,
+		"stats": s.Stats != nil,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == "HEAD" {
+		return
 	}
-	return c.Upload
+	w.Write(data)
 }
 
-func (c *AccessConf) canUpload(r *http.Request) bool {
-	token := r.FormValue("token")
-	if token != "" {
-		return c.canUploadByToken(token)
-	}
-	session, err := store.Get(r, defaultSessionName)
+// hTextList lists the directory one file per line for curl and wget, directories end with /
+func (s *HTTPStaticServer) hTextList(w http.ResponseWriter, r *http.Request, realPath string, auth *AccessConf) {
+	files, err := s.listFiles(r, mux.Vars(r)["path"], realPath, auth)
 	if err != nil {
-		return c.Upload
+		http.Error(w, err.Error(), 500)
+		return
 	}
-	val := session.Values["user"]
-	if val == nil {
-		return c.Upload
+	sortListing(files)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.Method == "HEAD" {
+		return
 	}
-	userInfo := val.(*UserInfo)
-
-	for _, rule := range c.Users {
-		if rule.Email == userInfo.Email {
-			return rule.Upload
+	for _, f := range files {
+		if f.Type == "dir" {
+			f.Name += "/"
 		}
+		fmt.Fprintln(w, f.Name)
 	}
-	return c.Upload
 }
 
-func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
-	requestPath := mux.Vars(r)["path"]
-	realPath := s.getRealPath(r)
+// sortListing sorts directories before files, then by name
+func sortListing(files []HTTPFileInfo) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].Type != files[j].Type {
+			return files[i].Type == "dir"
+		}
+		return files[i].Name < files[j].Name
+	})
+}
+
+// listFiles returns the files of the directory which the user can see, or the search results under it
+func (s *HTTPStaticServer) listFiles(r *http.Request, requestPath, realPath string, auth *AccessConf) ([]HTTPFileInfo, error) {
 	search := r.FormValue("search")
-	auth := s.readAccessConf(realPath)
-	auth.Upload = auth.canUpload(r)
-	auth.Delete = auth.canDelete(r)
 	maxDepth := s.DeepPathMaxDepth
 
 	// path string -> info os.FileInfo
@@ -584,35 +759,54 @@ func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
 
 	if search != "" {
 		results := s.findIndex(search)
-		if len(results) > 50 { // max 50
-			results = results[:50]
-		}
 		for _, item := range results {
-			if filepath.HasPrefix(item.Path, requestPath) {
-				fileInfoMap[item.Path] = item.Info
+			if len(fileInfoMap) >= 50 { // max 50
+				break
+			}
+			if !filepath.HasPrefix(item.Path, requestPath) {
+				continue
+			}
+			itemPath := s.realPathOf(item.Path)
+			if itemAuth := s.readAccessConf(itemPath); !itemAuth.canRead(r) {
+				continue
 			}
+			// access tables of the parent directory decide whether the item is visible
+			if dirAuth := s.readAccessConf(filepath.Dir(itemPath)); !dirAuth.visible(r, item.Path) {
+				continue
+			}
+			fileInfoMap[item.Path] = item.Info
 		}
 	} else {
-		infos, err := ioutil.ReadDir(realPath)
+		infos, err := s.fs().ReadDir(realPath)
 		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+			return nil, err
+		}
+		if auth.path == "/" && len(s.Mounts) > 0 {
+			infos = append(infos, s.mountInfos()...) // mount points replace files with the same name
 		}
 		for _, info := range infos {
+			if !auth.visible(r, path.Join(auth.path, info.Name())) {
+				continue
+			}
+			if info.IsDir() {
+				if dirAuth := s.readAccessConf(filepath.Join(realPath, info.Name())); !dirAuth.canList(r) {
+					continue
+				}
+			}
 			fileInfoMap[filepath.Join(requestPath, info.Name())] = info
 		}
 	}
 
+	downloads := s.Stats.Downloads(s.relativePath(realPath))
+
 	// turn file list -> json
 	lrs := make([]HTTPFileInfo, 0)
 	for path, info := range fileInfoMap {
-		if !auth.canAccess(info.Name()) {
-			continue
-		}
 		lr := HTTPFileInfo{
 			Name:    info.Name(),
 			Path:    path,
 			ModTime: info.ModTime().UnixNano() / 1e6,
+			Symlink: isSymlink(info),
 		}
 		if search != "" {
 			name, err := filepath.Rel(requestPath, path)
@@ -622,7 +816,7 @@ func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
 			lr.Name = filepath.ToSlash(name) // fix for windows
 		}
 		if info.IsDir() {
-			name := deepPath(realPath, info.Name(), maxDepth)
+			name := deepPath(s.fs(), realPath, info.Name(), maxDepth)
 			lr.Name = name
 			lr.Path = filepath.Join(filepath.Dir(path), name)
 			lr.Type = "dir"
@@ -630,39 +824,60 @@ func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
 		} else {
 			lr.Type = "file"
 			lr.Size = info.Size() // formatSize(info)
+			// search results are not only direct children
+			if search != "" {
+				lr.Downloads = s.Stats.Get("/" + filepath.ToSlash(path))
+			} else {
+				lr.Downloads = downloads["/"+filepath.ToSlash(path)]
+			}
 		}
 		lrs = append(lrs, lr)
 	}
-
-	data, _ := json.Marshal(map[string]interface{}{
-		"files": lrs,
-		"auth":  auth,
-	})
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(data)
+	return lrs, nil
 }
 
 var dirInfoSize = Directory{size: make(map[string]int64), mutex: &sync.RWMutex{}}
 
 func (s *HTTPStaticServer) makeIndex() error {
 	var indexes = make([]IndexFileItem, 0)
-	var err = filepath.Walk(s.Root, func(path string, info os.FileInfo, err error) error {
+	var err = s.walkIndex(s.Root, "/", &indexes)
+	for _, m := range s.Mounts {
+		if m.NoIndex {
+			continue
+		}
+		if mErr := s.walkIndex(m.Path, m.Prefix, &indexes); err == nil {
+			err = mErr
+		}
+	}
+	s.indexes = indexes
+	return err
+}
+
+// walkIndex adds files under root to indexes, prefix is the url path of root
+func (s *HTTPStaticServer) walkIndex(root, prefix string, indexes *[]IndexFileItem) error {
+	return walkStorage(s.fs(), root, func(realPath string, info os.FileInfo, err error) error {
 		if err != nil {
-			log.Printf("WARN: Visit path: %s error: %v", strconv.Quote(path), err)
+			log.Printf("WARN: Visit path: %s error: %v", strconv.Quote(realPath), err)
 			return filepath.SkipDir
 			// return err
 		}
+		rel, _ := filepath.Rel(root, realPath)
+		rel = path.Join(prefix, filepath.ToSlash(rel))
+		if rel != prefix && s.dirAccess(path.Dir(rel)).conf.hidden(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		if info.IsDir() {
+			if prefix == "/" && rel != "/" && s.mount(rel) != nil { // hidden by a mount point
+				return filepath.SkipDir
+			}
 			return nil
 		}
-
-		path, _ = filepath.Rel(s.Root, path)
-		path = filepath.ToSlash(path)
-		indexes = append(indexes, IndexFileItem{path, info})
+		*indexes = append(*indexes, IndexFileItem{strings.TrimPrefix(rel, "/"), info})
 		return nil
 	})
-	s.indexes = indexes
-	return err
 }
 
 func (s *HTTPStaticServer) historyDirSize(dir string) int64 {
@@ -714,43 +929,20 @@ func (s *HTTPStaticServer) findIndex(text string) []IndexFileItem {
 }
 
 func (s *HTTPStaticServer) defaultAccessConf() AccessConf {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return AccessConf{
+		Read:   true,
+		List:   true,
 		Upload: s.Upload,
 		Delete: s.Delete,
 	}
 }
 
-func (s *HTTPStaticServer) readAccessConf(realPath string) (ac AccessConf) {
-	relativePath, err := filepath.Rel(s.Root, realPath)
-	if err != nil || relativePath == "." || relativePath == "" { // actually relativePath is always "." if root == realPath
-		ac = s.defaultAccessConf()
-		realPath = s.Root
-	} else {
-		parentPath := filepath.Dir(realPath)
-		ac = s.readAccessConf(parentPath)
-	}
-	if isFile(realPath) {
-		realPath = filepath.Dir(realPath)
-	}
-	cfgFile := filepath.Join(realPath, YAMLCONF)
-	data, err := ioutil.ReadFile(cfgFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return
-		}
-		log.Printf("Err read .ghs.yml: %v", err)
-	}
-	err = yaml.Unmarshal(data, &ac)
-	if err != nil {
-		log.Printf("Err format .ghs.yml: %v", err)
-	}
-	return
-}
-
-func deepPath(basedir, name string, maxDepth int) string {
+func deepPath(fs Storage, basedir, name string, maxDepth int) string {
 	// loop max 5, incase of for loop not finished
 	for depth := 0; depth <= maxDepth; depth += 1 {
-		finfos, err := ioutil.ReadDir(filepath.Join(basedir, name))
+		finfos, err := fs.ReadDir(filepath.Join(basedir, name))
 		if err != nil || len(finfos) != 1 {
 			break
 		}
@@ -783,6 +975,12 @@ var (
 func init() {
 	funcMap = template.FuncMap{
 		"title": strings.Title,
+		"urlpath": func(p string) string {
+			return (&url.URL{Path: p}).EscapedPath()
+		},
+		"mtime": func(ms int64) string {
+			return time.Unix(0, ms*1e6).Format("2006-01-02 15:04:05")
+		},
 		"urlhash": func(path string) string {
 			httpFile, err := Assets.Open(path)
 			if err != nil {
@@ -823,7 +1021,13 @@ func (s *HTTPStaticServer) hVideoPlayer(w http.ResponseWriter, r *http.Request)
 	realPath := s.getRealPath(r)
 	extension := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
 
-	if _, err := os.Stat(realPath); os.IsNotExist(err) {
+	// checked before stat, so the existence of unreadable files is not revealed
+	auth := s.readAccessConf(realPath)
+	if !auth.canRead(r) {
+		s.deny(w, r, &auth, AuditRead)
+		return
+	}
+	if _, err := s.fs().Stat(realPath); os.IsNotExist(err) {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirectoryNegotiation(t *testing.T) {
+	root := t.TempDir()
+	for name, data := range map[string]string{
+		"b.txt":         "b",
+		"a#1.txt":       "a",
+		"docs/x/c.md":   "c",
+		"docs/y/d.md":   "d",
+		"{{secret}}.md": "v",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755)
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(root, name), []byte(data), 0644))
+	}
+	s := NewHTTPStaticServer(root, true)
+	get := func(url, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/", "text/plain")
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", w.Header().Get("Vary"))
+	assert.Equal(t, "docs/\na#1.txt\nb.txt\n{{secret}}.md\n", w.Body.String())
+	assert.Equal(t, "x/\ny/\n", get("/docs", "text/plain").Body.String())
+
+	w = get("/docs", "application/json, text/plain, */*")
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var list struct {
+		Files []HTTPFileInfo `json:"files"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Files, 2)
+
+	for _, accept := range []string{"text/plain", "application/json"} {
+		r := httptest.NewRequest("HEAD", "/docs", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), accept), accept)
+		assert.Empty(t, w.Body.String(), accept)
+	}
+
+	// the web UI by default, files are listed for browsers without javascript
+	for _, accept := range []string{"", "*/*", "text/html,application/xhtml+xml,*/*;q=0.8"} {
+		w = get("/", accept)
+		assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/html"), accept)
+		assert.Contains(t, w.Body.String(), `id="app"`)
+	}
+	body := w.Body.String()
+	assert.Contains(t, body, `<noscript v-pre>`)
+	assert.Contains(t, body, `href="/docs/"`)
+	assert.Contains(t, body, `href="/a%231.txt"`)
+	assert.NotContains(t, body, "fa-level-up")
+	assert.Contains(t, get("/docs/x", "").Body.String(), `href="/docs/"><i class="fa fa-level-up"></i>`)
+
+	// files are not listed in the preview of a file
+	assert.NotContains(t, get("/b.txt?raw=false", "").Body.String(), "<noscript")
+	assert.Equal(t, "b", get("/b.txt", "text/plain").Body.String())
+}
+
+func TestVideoPlayerAccess(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "private"), 0755)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "private", YAMLCONF), []byte("accessTables:\n- regex: '.*'\n  action: deny\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "private/a.mp4"), []byte("v"), 0644))
+	s := NewHTTPStaticServer(root, true)
+	get := func(url string) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w.Code
+	}
+	// files which can not be read do not reveal whether they exist
+	assert.Equal(t, get("/-/video-player/private/a.mp4"), get("/-/video-player/private/missing.mp4"))
+	assert.NotEqual(t, 200, get("/-/video-player/private/a.mp4"))
+}
+
+func TestUploadUnzipAccess(t *testing.T) {
+	root := t.TempDir()
+	for name, data := range map[string]string{
+		"app.conf": "old",
+		YAMLCONF:   "upload: true\naccessTables:\n- glob: '*.conf'\n  action: read-only\n",
+	} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(root, name), []byte(data), 0644))
+	}
+	s := NewHTTPStaticServer(root, true)
+	s.Hidden = HiddenConf{Dotfiles: true}
+	upload := func(entries ...string) *httptest.ResponseRecorder {
+		var archive bytes.Buffer
+		zw := zip.NewWriter(&archive)
+		for _, entry := range entries {
+			fw, _ := zw.Create(entry)
+			fw.Write([]byte("new"))
+		}
+		zw.Close()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "files.zip")
+		fw.Write(archive.Bytes())
+		mw.WriteField("unzip", "true")
+		mw.Close()
+		r := httptest.NewRequest("POST", "/", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	// entries which can not be uploaded one by one are not extracted
+	assert.Contains(t, upload("a.txt", "app.conf").Body.String(), `"success":false`)
+	assert.Contains(t, upload("a.txt", ".env").Body.String(), `"success":false`)
+	assert.Contains(t, upload("a.txt", "sub/.git/config").Body.String(), `"success":false`)
+	data, _ := ioutil.ReadFile(filepath.Join(root, "app.conf"))
+	assert.Equal(t, "old", string(data))
+	assert.False(t, fileExists(filepath.Join(root, ".env")))
+	assert.False(t, fileExists(filepath.Join(root, "a.txt")))
+
+	assert.Contains(t, upload("a.txt", "sub/b.txt").Body.String(), `"success":true`)
+	assert.True(t, fileExists(filepath.Join(root, "sub/b.txt")))
+	assert.False(t, fileExists(filepath.Join(root, "files.zip")))
+}
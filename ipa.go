@@ -14,13 +14,17 @@ import (
 	//goplist "github.com/DHowett/go-plist"
 )
 
-func parseIpaIcon(path string) (data []byte, err error) {
+func parseIpaIcon(fs Storage, path string) (data []byte, err error) {
 	iconPattern := regexp.MustCompile(`(?i)^Payload/[^/]*/icon\.png$`)
-	r, err := zip.OpenReader(path)
+	f, size, err := openSized(fs, path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	r, err := zip.NewReader(f, size)
 	if err != nil {
 		return
 	}
-	defer r.Close()
 
 	var zfile *zip.File
 	for _, file := range r.File {
@@ -41,13 +45,17 @@ func parseIpaIcon(path string) (data []byte, err error) {
 	return ioutil.ReadAll(plreader)
 }
 
-func parseIPA(path string) (plinfo *plistBundle, err error) {
+func parseIPA(fs Storage, path string) (plinfo *plistBundle, err error) {
 	plistre := regexp.MustCompile(`^Payload/[^/]*/Info\.plist$`)
-	r, err := zip.OpenReader(path)
+	f, size, err := openSized(fs, path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	r, err := zip.NewReader(f, size)
 	if err != nil {
 		return
 	}
-	defer r.Close()
 
 	var plfile *zip.File
 	for _, file := range r.File {
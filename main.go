@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -44,27 +45,52 @@ type Configure struct {
 	Debug           bool     `yaml:"debug"`
 	GoogleTrackerID string   `yaml:"google-tracker-id"`
 	Auth            struct {
-		Type   string   `yaml:"type"` // openid|http|github
-		OpenID string   `yaml:"openid"`
-		HTTP   []string `yaml:"http"`
-		ID     string   `yaml:"id"`     // for oauth2
-		Secret string   `yaml:"secret"` // for oauth2
+		Type         string   `yaml:"type"` // openid|http|github|oauth2-proxy|mtls
+		OpenID       string   `yaml:"openid"`
+		HTTP         []string `yaml:"http"`
+		ID           string   `yaml:"id"`            // for oauth2
+		Secret       string   `yaml:"secret"`        // for oauth2
+		ClientCA     string   `yaml:"client-ca"`     // for mtls
+		ClientVerify string   `yaml:"client-verify"` // for mtls, required|optional
+		Header       struct { // for header|oauth2-proxy
+			Email          string   `yaml:"email"`
+			User           string   `yaml:"user"`
+			Name           string   `yaml:"name"`
+			Groups         string   `yaml:"groups"`
+			TrustedProxies []string `yaml:"trusted-proxies"`
+		} `yaml:"header"`
 	} `yaml:"auth"`
-	DeepPathMaxDepth int  `yaml:"deep-path-max-depth"`
-	NoIndex          bool `yaml:"no-index"`
-}
-
-type httpLogger struct{}
-
-func (l httpLogger) Log(record accesslog.LogRecord) {
-	log.Printf("%s - %s %d %s", record.Ip, record.Method, record.Status, record.Uri)
+	Groups           map[string][]string `yaml:"groups"` // group name -> member emails
+	Admins           []string            `yaml:"admins"` // email, wildcard email or group:<name>
+	TokenFile        string              `yaml:"token-file"`
+	ShareFile        string              `yaml:"share-file"`
+	CORS             CORSConfig          `yaml:"cors"`
+	AuditLog         string              `yaml:"audit-log"`
+	AuditMaxSize     int                 `yaml:"audit-log-max-size"`     // MB
+	AuditMaxBackups  int                 `yaml:"audit-log-max-backups"`  // number of rotated files to keep
+	AccessLog        string              `yaml:"access-log"`             // empty means the application log
+	AccessLogFormat  string              `yaml:"access-log-format"`      // default|common|combined|json
+	AccessMaxSize    int                 `yaml:"access-log-max-size"`    // MB
+	AccessMaxBackups int                 `yaml:"access-log-max-backups"` // number of rotated files to keep
+	AccessLogRotate  string              `yaml:"access-log-rotate"`      // hourly|daily
+	MetricsToken     string              `yaml:"metrics-token"`          // bearer token required by /-/metrics
+	StatsFile        string              `yaml:"stats-file"`
+	RateLimit        RateLimitConf       `yaml:"rate-limit"`
+	Mounts           []Mount             `yaml:"mounts"`
+	Storage          StorageConf         `yaml:"storage"`
+	Symlinks         string              `yaml:"symlinks"` // follow|follow-within-root|deny
+	Hidden           HiddenConf          `yaml:"hidden"`
+	S3API            S3APIConf           `yaml:"s3-api"`
+	SFTP             SFTPConf            `yaml:"sftp"`
+	DeepPathMaxDepth int                 `yaml:"deep-path-max-depth"`
+	NoIndex          bool                `yaml:"no-index"`
 }
 
 var (
 	defaultPlistProxy = "https://plistproxy.herokuapp.com/plist"
 	defaultOpenID     = "https://login.netease.com/openid"
 	gcfg              = Configure{}
-	logger            = httpLogger{}
+	logger            = &httpLogger{}
 
 	VERSION   = "unknown"
 	BUILDTIME = "unknown time"
@@ -92,55 +118,111 @@ func versionMessage() string {
 	return buf.String()
 }
 
-func parseFlags() error {
+// newFlagApp returns the command line parser which stores flags into cfg, defaults are set to cfg at the same time
+func newFlagApp(cfg *Configure) *kingpin.Application {
 	// initial default conf
-	gcfg.Root = "./"
-	gcfg.Port = 8000
-	gcfg.Addr = ""
-	gcfg.Theme = "black"
-	gcfg.PlistProxy = defaultPlistProxy
-	gcfg.Auth.OpenID = defaultOpenID
-	gcfg.GoogleTrackerID = "UA-81205425-2"
-	gcfg.Title = "Go HTTP File Server"
-	gcfg.DeepPathMaxDepth = 5
-	gcfg.NoIndex = false
-
-	kingpin.HelpFlag.Short('h')
-	kingpin.Version(versionMessage())
-	kingpin.Flag("conf", "config file path, yaml format").FileVar(&gcfg.Conf)
-	kingpin.Flag("root", "root directory, default ./").Short('r').StringVar(&gcfg.Root)
-	kingpin.Flag("prefix", "url prefix, eg /foo").StringVar(&gcfg.Prefix)
-	kingpin.Flag("port", "listen port, default 8000").IntVar(&gcfg.Port)
-	kingpin.Flag("addr", "listen address, eg 127.0.0.1:8000").Short('a').StringVar(&gcfg.Addr)
-	kingpin.Flag("cert", "tls cert.pem path").StringVar(&gcfg.Cert)
-	kingpin.Flag("key", "tls key.pem path").StringVar(&gcfg.Key)
-	kingpin.Flag("auth-type", "Auth type <http|openid>").StringVar(&gcfg.Auth.Type)
-	kingpin.Flag("auth-http", "HTTP basic auth (ex: user:pass)").StringsVar(&gcfg.Auth.HTTP)
-	kingpin.Flag("auth-openid", "OpenID auth identity url").StringVar(&gcfg.Auth.OpenID)
-	kingpin.Flag("theme", "web theme, one of <black|green>").StringVar(&gcfg.Theme)
-	kingpin.Flag("upload", "enable upload support").BoolVar(&gcfg.Upload)
-	kingpin.Flag("delete", "enable delete support").BoolVar(&gcfg.Delete)
-	kingpin.Flag("xheaders", "used when behide nginx").BoolVar(&gcfg.XHeaders)
-	kingpin.Flag("debug", "enable debug mode").BoolVar(&gcfg.Debug)
-	kingpin.Flag("plistproxy", "plist proxy when server is not https").Short('p').StringVar(&gcfg.PlistProxy)
-	kingpin.Flag("title", "server title").StringVar(&gcfg.Title)
-	kingpin.Flag("google-tracker-id", "set to empty to disable it").StringVar(&gcfg.GoogleTrackerID)
-	kingpin.Flag("deep-path-max-depth", "set to -1 to not combine dirs").IntVar(&gcfg.DeepPathMaxDepth)
-	kingpin.Flag("no-index", "disable indexing").BoolVar(&gcfg.NoIndex)
-
-	kingpin.Parse() // first parse conf
+	cfg.Root = "./"
+	cfg.Port = 8000
+	cfg.Addr = ""
+	cfg.Theme = "black"
+	cfg.PlistProxy = defaultPlistProxy
+	cfg.Auth.OpenID = defaultOpenID
+	cfg.GoogleTrackerID = "UA-81205425-2"
+	cfg.Title = "Go HTTP File Server"
+	cfg.DeepPathMaxDepth = 5
+	cfg.NoIndex = false
+	cfg.CORS.Enabled = true
+	cfg.AuditMaxSize = 100
+	cfg.AuditMaxBackups = 10
+	cfg.AccessMaxSize = 100
+	cfg.AccessMaxBackups = 10
+	cfg.Symlinks = SymlinkFollowWithinRoot
 
-	if gcfg.Conf != nil {
-		defer func() {
-			kingpin.Parse() // command line priority high than conf
-		}()
-		ymlData, err := ioutil.ReadAll(gcfg.Conf)
-		if err != nil {
-			return err
-		}
-		return yaml.Unmarshal(ymlData, &gcfg)
+	app := kingpin.New(filepath.Base(os.Args[0]), "")
+	app.HelpFlag.Short('h')
+	app.Version(versionMessage())
+	app.Flag("conf", "config file path, yaml format").FileVar(&cfg.Conf)
+	app.Flag("root", "root directory, default ./").Short('r').StringVar(&cfg.Root)
+	app.Flag("prefix", "url prefix, eg /foo").StringVar(&cfg.Prefix)
+	app.Flag("port", "listen port, default 8000").IntVar(&cfg.Port)
+	app.Flag("addr", "listen address, eg 127.0.0.1:8000").Short('a').StringVar(&cfg.Addr)
+	app.Flag("cert", "tls cert.pem path").StringVar(&cfg.Cert)
+	app.Flag("key", "tls key.pem path").StringVar(&cfg.Key)
+	app.Flag("auth-type", "Auth type <http|openid|oauth2-proxy|header|mtls>").StringVar(&cfg.Auth.Type)
+	app.Flag("auth-http", "HTTP basic auth (ex: user:pass)").StringsVar(&cfg.Auth.HTTP)
+	app.Flag("auth-openid", "OpenID auth identity url").StringVar(&cfg.Auth.OpenID)
+	app.Flag("auth-client-ca", "client CA bundle for mtls auth").StringVar(&cfg.Auth.ClientCA)
+	app.Flag("auth-client-verify", "client certificate verify for mtls auth <required|optional>").StringVar(&cfg.Auth.ClientVerify)
+	app.Flag("auth-trusted-proxy", "trusted reverse proxy ip or cidr for header auth, can be repeated").StringsVar(&cfg.Auth.Header.TrustedProxies)
+	app.Flag("theme", "web theme, one of <black|green>").StringVar(&cfg.Theme)
+	app.Flag("upload", "enable upload support").BoolVar(&cfg.Upload)
+	app.Flag("delete", "enable delete support").BoolVar(&cfg.Delete)
+	app.Flag("xheaders", "used when behide nginx").BoolVar(&cfg.XHeaders)
+	app.Flag("debug", "enable debug mode").BoolVar(&cfg.Debug)
+	app.Flag("plistproxy", "plist proxy when server is not https").Short('p').StringVar(&cfg.PlistProxy)
+	app.Flag("title", "server title").StringVar(&cfg.Title)
+	app.Flag("google-tracker-id", "set to empty to disable it").StringVar(&cfg.GoogleTrackerID)
+	app.Flag("deep-path-max-depth", "set to -1 to not combine dirs").IntVar(&cfg.DeepPathMaxDepth)
+	app.Flag("no-index", "disable indexing").BoolVar(&cfg.NoIndex)
+	app.Flag("token-file", "file to store api tokens, api tokens are disabled if empty").StringVar(&cfg.TokenFile)
+	app.Flag("access-log", "access log file, default to the application log").StringVar(&cfg.AccessLog)
+	app.Flag("access-log-format", "access log format <default|common|combined|json>").StringVar(&cfg.AccessLogFormat)
+	app.Flag("access-log-rotate", "rotate access log file <hourly|daily>, it is always rotated by size").StringVar(&cfg.AccessLogRotate)
+	app.Flag("metrics-token", "bearer token required by /-/metrics, admins only if empty and auth is enabled, public if no auth").StringVar(&cfg.MetricsToken)
+	app.Flag("audit-log", "audit log file of writes and permission decisions, disabled if empty").StringVar(&cfg.AuditLog)
+	app.Flag("rate-limit", "requests per second of every user or ip, 0 means unlimited").Float64Var(&cfg.RateLimit.Requests)
+	app.Flag("max-downloads", "concurrent downloads per ip, 0 means unlimited").IntVar(&cfg.RateLimit.Downloads)
+	app.Flag("bandwidth", "bandwidth of all downloads, eg: 100MB").StringVar(&cfg.RateLimit.Bandwidth)
+	app.Flag("conn-bandwidth", "bandwidth of every download, eg: 10MB").StringVar(&cfg.RateLimit.ConnBandwidth)
+	app.Flag("stats-file", "database file of download statistics, disabled if empty").StringVar(&cfg.StatsFile)
+	app.Flag("symlinks", "symlink policy <follow|follow-within-root|deny>, default follow-within-root").StringVar(&cfg.Symlinks)
+	app.Flag("hide-dotfiles", "hide files and directories whose name starts with . from everyone").BoolVar(&cfg.Hidden.Dotfiles)
+	app.Flag("hide", "gitignore style pattern of hidden files, can be repeated").StringsVar(&cfg.Hidden.Patterns)
+	app.Flag("share-file", "file to store share links, share links are lost after restart if empty").StringVar(&cfg.ShareFile)
+
+	app.Command("serve", "start http file server").Default()
+	app.Command("check-config", "validate the config file and every "+YAMLCONF+" under root")
+	tokenCmd := app.Command("token", "manage api tokens")
+	createCmd := tokenCmd.Command("create", "create a new api token")
+	createCmd.Flag("name", "token name").StringVar(&tokenArgs.Name)
+	createCmd.Flag("owner", "owner email of the token").StringVar(&tokenArgs.Owner)
+	createCmd.Flag("scope", "read|upload|delete|admin, can be repeated").Required().StringsVar(&tokenArgs.Scopes)
+	createCmd.Flag("path", "restrict token to path, can be repeated").StringsVar(&tokenArgs.Paths)
+	createCmd.Flag("expires", "expire after duration, eg: 720h, 30d").StringVar(&tokenArgs.Expires)
+	tokenCmd.Command("list", "list api tokens")
+	tokenCmd.Command("revoke", "revoke an api token").Arg("id", "token id").Required().StringVar(&tokenArgs.ID)
+	return app
+}
+
+// readConfig reads config from the command line and the config file, command line has higher priority.
+// Errors of the config file are returned as *confFileError after the command line is parsed.
+func readConfig(cfg *Configure) (command string, err error) {
+	app := newFlagApp(cfg)
+	command, err = app.Parse(os.Args[1:]) // first parse conf
+	if err != nil || cfg.Conf == nil {
+		return command, err
+	}
+	ymlData, err := ioutil.ReadAll(cfg.Conf)
+	cfg.Conf.Close()
+	if err != nil {
+		return command, err
 	}
-	return nil
+	var fileErr error
+	if err = unmarshalStrict(ymlData, cfg); err != nil {
+		fileErr = &confFileError{name: cfg.Conf.Name(), err: err}
+	}
+	command, err = app.Parse(os.Args[1:]) // command line priority high than conf
+	if cfg.Conf != nil {
+		cfg.Conf.Close()
+	}
+	if err == nil {
+		err = fileErr
+	}
+	return command, err
+}
+
+func parseFlags() (command string, err error) {
+	return readConfig(&gcfg)
 }
 
 func fixPrefix(prefix string) string {
@@ -154,17 +236,14 @@ func fixPrefix(prefix string) string {
 	return prefix
 }
 
-func cors(next http.Handler) http.Handler {
-	// access control and CORS middleware
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "*")
-		if r.Method == "OPTIONS" {
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
+func fixAddr(addr string, port int) string {
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", port)
+	}
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+	return addr
 }
 
 func multiBasicAuth(auths []string) func(http.Handler) http.Handler {
@@ -190,9 +269,26 @@ func multiBasicAuth(auths []string) func(http.Handler) http.Handler {
 }
 
 func main() {
-	if err := parseFlags(); err != nil {
+	command, err := parseFlags()
+	fileErr, _ := err.(*confFileError)
+	if err != nil && (fileErr == nil || command != "check-config") {
 		log.Fatal(err)
 	}
+	if command == "check-config" { // problems of the config file are listed together with the others
+		if checkConfig(os.Stdout, &gcfg, fileErr) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if errs := validateConfig(&gcfg); len(errs) > 0 {
+		log.Fatalf("invalid config:\n%v", errs)
+	}
+	if strings.HasPrefix(command, "token ") {
+		if err := runTokenCommand(command); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if gcfg.Debug {
 		data, _ := yaml.Marshal(gcfg)
 		fmt.Printf("--- config ---\n%s\n", string(data))
@@ -205,7 +301,26 @@ func main() {
 		log.Printf("url prefix: %s", gcfg.Prefix)
 	}
 
-	ss := NewHTTPStaticServer(gcfg.Root, gcfg.NoIndex)
+	logger, err = newHTTPLogger(gcfg.AccessLog, gcfg.AccessLogFormat, int64(gcfg.AccessMaxSize)<<20, gcfg.AccessMaxBackups, gcfg.AccessLogRotate)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	storage, err := rootStorage(&gcfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	root := gcfg.Root
+	switch storage.(type) {
+	case *S3Storage:
+		root = "/" // names of the files in the bucket
+		log.Printf("storage: s3 bucket %s, prefix %s", gcfg.Storage.Bucket, strconv.Quote(gcfg.Storage.Prefix))
+	case fsStorage:
+		root = "/"
+		log.Printf("serve archive %s read-only", gcfg.Root)
+	}
+	ss := NewHTTPStaticServer(root, gcfg.NoIndex)
+	ss.Storage = storage
 	ss.Prefix = gcfg.Prefix
 	ss.Theme = gcfg.Theme
 	ss.Title = gcfg.Title
@@ -214,6 +329,40 @@ func main() {
 	ss.Delete = gcfg.Delete
 	ss.AuthType = gcfg.Auth.Type
 	ss.DeepPathMaxDepth = gcfg.DeepPathMaxDepth
+	ss.Mounts = fixMounts(gcfg.Mounts)
+	ss.Symlinks = gcfg.Symlinks
+	ss.Hidden = gcfg.Hidden
+	for _, m := range ss.Mounts {
+		log.Printf("mount %s at %s", m.Path, m.Prefix)
+	}
+	if gcfg.TokenFile != "" {
+		ss.Tokens, err = OpenTokenStore(gcfg.TokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if gcfg.AuditLog != "" {
+		ss.Audit, err = OpenAuditLog(gcfg.AuditLog, int64(gcfg.AuditMaxSize)<<20, gcfg.AuditMaxBackups)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	ss.Limiter, err = NewRateLimiter(gcfg.RateLimit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if gcfg.StatsFile != "" {
+		ss.Stats, err = OpenStatsStore(gcfg.StatsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if gcfg.ShareFile != "" {
+		ss.Shares, err = OpenShareStore(gcfg.ShareFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	if gcfg.PlistProxy != "" {
 		u, err := url.Parse(gcfg.PlistProxy)
@@ -229,22 +378,58 @@ func main() {
 
 	var hdlr http.Handler = ss
 
-	hdlr = accesslog.NewLoggingHandler(hdlr, logger)
+	hdlr = csrfProtect(hdlr)
+	hdlr = reloadable(hdlr, func(next http.Handler) http.Handler {
+		return ss.limiter().Middleware(next)
+	})
+	hdlr = accesslog.NewLoggingHandler(withLogUser(hdlr), logger)
+	loggingHdlr := hdlr
 
 	// HTTP Basic Authentication
+	var headerAuth *HeaderAuth
 	switch gcfg.Auth.Type {
 	case "http":
-		hdlr = multiBasicAuth(gcfg.Auth.HTTP)(hdlr)
+		hdlr = reloadable(hdlr, multiBasicAuthFromConfig)
 	case "openid":
 		handleOpenID(gcfg.Auth.OpenID, false) // FIXME(ssx): set secure default to false
 		// case "github":
 		// 	handleOAuth2ID(gcfg.Auth.Type, gcfg.Auth.ID, gcfg.Auth.Secret) // FIXME(ssx): set secure default to false
-	case "oauth2-proxy":
-		handleOauth2()
+	case "oauth2-proxy", "header":
+		headerAuth, err = NewHeaderAuth(gcfg.Auth.Header.TrustedProxies)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hc := gcfg.Auth.Header
+		if hc.Email != "" {
+			headerAuth.EmailHeader = hc.Email
+		}
+		if hc.User != "" {
+			headerAuth.UserHeader = hc.User
+		}
+		if hc.Name != "" {
+			headerAuth.NameHeader = hc.Name
+		}
+		if hc.Groups != "" {
+			headerAuth.GroupsHeader = hc.Groups
+		}
+		log.Printf("header auth: trust %s from %v", headerAuth.EmailHeader, headerAuth.trusted)
+		handleHeaderAuth()
+	case "mtls":
+		if gcfg.Key == "" || gcfg.Cert == "" {
+			log.Fatal("auth type mtls requires --cert and --key")
+		}
+		handleMTLS()
+	}
+
+	// API tokens skip the login above
+	if ss.Tokens != nil {
+		hdlr = bearerTokenAuth(ss.Tokens, loggingHdlr, hdlr)
 	}
 
 	// CORS
-	hdlr = cors(hdlr)
+	hdlr = reloadable(hdlr, func(next http.Handler) http.Handler {
+		return cors(gcfg.CORS, next)
+	})
 
 	if gcfg.XHeaders {
 		hdlr = handlers.ProxyHeaders(hdlr)
@@ -269,23 +454,74 @@ func main() {
 		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
 		w.Write(data)
 	})
-	router.PathPrefix("/").Handler(hdlr)
-
-	if gcfg.Addr == "" {
-		gcfg.Addr = fmt.Sprintf(":%d", gcfg.Port)
+	if gcfg.MetricsToken != "" { // scrapers can not login, the token is checked instead
+		router.HandleFunc("/-/metrics", hMetricsToken(gcfg.MetricsToken))
 	}
-	if !strings.Contains(gcfg.Addr, ":") {
-		gcfg.Addr = ":" + gcfg.Addr
+	// share links are public, no login required
+	shareHdlr := accesslog.NewLoggingHandler(reloadable(http.HandlerFunc(ss.hShareAccess), func(next http.Handler) http.Handler {
+		return ss.limiter().Middleware(next)
+	}), logger)
+	router.Handle("/-/s/{token}", shareHdlr)
+	router.Handle("/-/s/{token}/{path:.*}", shareHdlr)
+	// handlers registered by auth types, eg: /-/user /-/login
+	for _, path := range []string{"/-/user", "/-/login", "/-/logout", "/-/openidcallback"} {
+		router.Handle(path, http.DefaultServeMux)
 	}
+	router.PathPrefix("/").Handler(hdlr)
+
+	gcfg.Addr = fixAddr(gcfg.Addr, gcfg.Port)
 	_, port, _ := net.SplitHostPort(gcfg.Addr)
 	log.Printf("listening on %s, local address http://%s:%s\n", strconv.Quote(gcfg.Addr), getLocalIP(), port)
 
+	if gcfg.Conf != nil {
+		go watchConfig(ss, gcfg.Conf.Name())
+	}
+
 	srv := &http.Server{
 		Handler: mainRouter,
 		Addr:    gcfg.Addr,
 	}
+	srv.Handler = ss.metricsMiddleware(mainRouter)
+	if headerAuth != nil {
+		srv.Handler = headerAuth.Middleware(srv.Handler)
+	}
+	if gcfg.Auth.Type == "mtls" {
+		srv.TLSConfig, err = newClientTLSConfig(gcfg.Auth.ClientCA, gcfg.Auth.ClientVerify)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if gcfg.S3API.Addr != "" {
+		s3api := NewS3API(ss, gcfg.S3API)
+		s3Srv := &http.Server{
+			Addr: gcfg.S3API.Addr,
+			Handler: accesslog.NewLoggingHandler(s3api.Handler(func(next http.Handler) http.Handler {
+				return withLogUser(reloadable(next, func(next http.Handler) http.Handler {
+					return ss.limiter().Middleware(next)
+				}))
+			}), logger),
+		}
+		log.Printf("s3 api: bucket %s listening on %s", s3api.conf.Bucket, strconv.Quote(gcfg.S3API.Addr))
+		go func() {
+			if gcfg.Key != "" && gcfg.Cert != "" {
+				log.Fatal(s3Srv.ListenAndServeTLS(gcfg.Cert, gcfg.Key))
+			}
+			log.Fatal(s3Srv.ListenAndServe())
+		}()
+	}
+
+	if gcfg.SFTP.Addr != "" {
+		sftpSrv, err := NewSFTPServer(ss, gcfg.SFTP)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("sftp: listening on %s", strconv.Quote(gcfg.SFTP.Addr))
+		go func() {
+			log.Fatal(sftpSrv.ListenAndServe())
+		}()
+	}
 
-	var err error
 	if gcfg.Key != "" && gcfg.Cert != "" {
 		err = srv.ListenAndServeTLS(gcfg.Cert, gcfg.Key)
 	} else {
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// internal pages which are reported as handler, others under /-/ are reported as "other"
+var metricsPages = []string{"assets", "sysinfo", "user", "login", "logout", "openidcallback",
+	"tokens", "share", "s", "audit", "stats", "debug", "ipa", "video-player", "metrics"}
+
+type histogram struct {
+	counts []uint64 // not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, bound := range durationBuckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type requestKey struct {
+	handler string
+	method  string
+	code    int
+}
+
+// Metrics are exposed in prometheus text format
+type Metrics struct {
+	mu           sync.Mutex
+	requests     map[requestKey]uint64
+	durations    map[string]*histogram
+	authFailures map[int]uint64
+
+	bytesServed     int64
+	bytesUploaded   int64
+	activeDownloads int64
+	indexFiles      int64
+	indexDuration   int64 // nanoseconds
+}
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:     make(map[requestKey]uint64),
+		durations:    make(map[string]*histogram),
+		authFailures: make(map[int]uint64),
+	}
+}
+
+func (m *Metrics) observe(handler, method string, code int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{handler, method, code}]++
+	h, ok := m.durations[handler]
+	if !ok {
+		h = &histogram{}
+		m.durations[handler] = h
+	}
+	h.observe(duration.Seconds())
+	if code == http.StatusUnauthorized || code == http.StatusForbidden {
+		m.authFailures[code]++
+	}
+}
+
+// setIndex records result of the last makeIndex
+func (m *Metrics) setIndex(files int, duration time.Duration) {
+	atomic.StoreInt64(&m.indexFiles, int64(files))
+	atomic.StoreInt64(&m.indexDuration, int64(duration))
+}
+
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	buf := bytes.NewBuffer(nil)
+	m.mu.Lock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.handler != b.handler {
+			return a.handler < b.handler
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	buf.WriteString("# HELP ghs_http_requests_total Total number of http requests.\n")
+	buf.WriteString("# TYPE ghs_http_requests_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(buf, "ghs_http_requests_total{handler=%q,method=%q,code=\"%d\"} %d\n", k.handler, k.method, k.code, m.requests[k])
+	}
+
+	handlers := make([]string, 0, len(m.durations))
+	for name := range m.durations {
+		handlers = append(handlers, name)
+	}
+	sort.Strings(handlers)
+	buf.WriteString("# HELP ghs_http_request_duration_seconds Latency of http requests.\n")
+	buf.WriteString("# TYPE ghs_http_request_duration_seconds histogram\n")
+	for _, name := range handlers {
+		h := m.durations[name]
+		var cumulative uint64
+		for i, bound := range durationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(buf, "ghs_http_request_duration_seconds_bucket{handler=%q,le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(buf, "ghs_http_request_duration_seconds_bucket{handler=%q,le=\"+Inf\"} %d\n", name, h.count)
+		fmt.Fprintf(buf, "ghs_http_request_duration_seconds_sum{handler=%q} %g\n", name, h.sum)
+		fmt.Fprintf(buf, "ghs_http_request_duration_seconds_count{handler=%q} %d\n", name, h.count)
+	}
+
+	buf.WriteString("# HELP ghs_auth_failures_total Total number of requests rejected with 401 or 403.\n")
+	buf.WriteString("# TYPE ghs_auth_failures_total counter\n")
+	for _, code := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		fmt.Fprintf(buf, "ghs_auth_failures_total{code=\"%d\"} %d\n", code, m.authFailures[code])
+	}
+	m.mu.Unlock()
+
+	for _, g := range []struct {
+		name, typ, help string
+		value           float64
+	}{
+		{"ghs_served_bytes_total", "counter", "Total bytes of response bodies.", float64(atomic.LoadInt64(&m.bytesServed))},
+		{"ghs_uploaded_bytes_total", "counter", "Total bytes of upload request bodies.", float64(atomic.LoadInt64(&m.bytesUploaded))},
+		{"ghs_active_downloads", "gauge", "Number of downloads and archives in progress.", float64(atomic.LoadInt64(&m.activeDownloads))},
+		{"ghs_index_files", "gauge", "Number of files in the search index.", float64(atomic.LoadInt64(&m.indexFiles))},
+		{"ghs_index_duration_seconds", "gauge", "Duration of the last search index build.", time.Duration(atomic.LoadInt64(&m.indexDuration)).Seconds()},
+	} {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", g.name, g.help, g.name, g.typ, g.name, g.value)
+	}
+	return buf.WriteTo(w)
+}
+
+type metricsWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *metricsWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(&metrics.bytesServed, int64(n))
+	return n, err
+}
+
+// ReadFrom keeps sendfile of the underlying writer for file downloads
+func (w *metricsWriter) ReadFrom(src io.Reader) (n int64, err error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, src)
+	}
+	atomic.AddInt64(&metrics.bytesServed, n)
+	return n, err
+}
+
+func (w *metricsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	return h.Hijack()
+}
+
+func (w *metricsWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type countingReader struct {
+	io.ReadCloser
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&metrics.bytesUploaded, int64(n))
+	return n, err
+}
+
+// metricsLabel is the handler label of a request, handlers which know better can change it
+type metricsLabel struct {
+	name string
+}
+
+// setMetricsHandler changes the handler label of the request, eg: index for a directory without trailing slash
+func setMetricsHandler(r *http.Request, name string) {
+	if label, ok := r.Context().Value(ctxKeyMetrics).(*metricsLabel); ok {
+		label.name = name
+	}
+}
+
+// handlerName returns the handler which serves the request, used as metrics label.
+// It is decided by the url only, files are not accessed before auth.
+func (s *HTTPStaticServer) handlerName(r *http.Request) string {
+	urlPath := strings.TrimPrefix(r.URL.Path, s.Prefix)
+	if strings.HasPrefix(urlPath, "/-/") {
+		page := strings.SplitN(urlPath[3:], "/", 2)[0]
+		if stringInSlice(page, metricsPages) {
+			return page
+		}
+		return "other"
+	}
+	switch r.Method {
+	case "POST":
+		return "upload"
+	case "DELETE":
+		return "delete"
+	}
+	query := r.URL.Query()
+	switch {
+	case query.Get("json") == "true" && query.Get("search") != "":
+		return "search"
+	case query.Get("json") == "true":
+		return "jsonlist"
+	case query.Get("op") == "archive":
+		return "archive"
+	case query.Get("op") == "info":
+		return "info"
+	case query.Get("raw") == "false", strings.HasSuffix(urlPath, "/"):
+		return "index"
+	}
+	return "download"
+}
+
+// metricsMiddleware collects metrics of every request
+func (s *HTTPStaticServer) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		name := s.handlerName(r)
+		label := &metricsLabel{name: name}
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeyMetrics, label))
+		if name == "upload" && r.Body != nil {
+			r.Body = countingReader{r.Body}
+		}
+		if name == "download" || name == "archive" {
+			atomic.AddInt64(&metrics.activeDownloads, 1)
+			defer atomic.AddInt64(&metrics.activeDownloads, -1)
+		}
+		mw := &metricsWriter{ResponseWriter: w}
+		next.ServeHTTP(mw, r)
+		if mw.status == 0 {
+			mw.status = http.StatusOK
+		}
+		metrics.observe(label.name, r.Method, mw.status, time.Since(start))
+	})
+}
+
+func writeMetrics(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WriteTo(w)
+}
+
+// hMetricsToken serves metrics without login, it requires "Authorization: Bearer <token>"
+func hMetricsToken(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Metrics token required", http.StatusUnauthorized)
+			return
+		}
+		writeMetrics(w)
+	}
+}
+
+// hMetrics serves metrics when metrics-token is not set, only to admins if login is enabled
+func (s *HTTPStaticServer) hMetrics(w http.ResponseWriter, r *http.Request) {
+	if s.AuthType != "" && !isAdmin(r) {
+		http.Error(w, "Admin required", http.StatusForbidden)
+		return
+	}
+	writeMetrics(w)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	m.observe("download", "GET", 200, 30*time.Millisecond)
+	m.observe("upload", "POST", 403, time.Second)
+	m.setIndex(42, 2*time.Second)
+
+	buf := bytes.NewBuffer(nil)
+	_, err := m.WriteTo(buf)
+	assert.NoError(t, err)
+	text := buf.String()
+	assert.Contains(t, text, `ghs_http_requests_total{handler="download",method="GET",code="200"} 1`)
+	assert.Contains(t, text, `ghs_http_request_duration_seconds_bucket{handler="download",le="0.025"} 0`)
+	assert.Contains(t, text, `ghs_http_request_duration_seconds_bucket{handler="download",le="0.05"} 1`)
+	assert.Contains(t, text, `ghs_http_request_duration_seconds_count{handler="upload"} 1`)
+	assert.Contains(t, text, `ghs_auth_failures_total{code="403"} 1`)
+	assert.Contains(t, text, "ghs_index_files 42\n")
+	assert.Contains(t, text, "ghs_index_duration_seconds 2\n")
+}
+
+func TestHandlerName(t *testing.T) {
+	s := &HTTPStaticServer{Root: "testdata/"}
+	for url, name := range map[string]string{
+		"/":                       "index",
+		"/filetypes/":             "index",
+		"/README.md?raw=false":    "index",
+		"/filetypes":              "download", // changed to index by the handler
+		"/config.yml":             "download",
+		"/?json=true":             "jsonlist",
+		"/?json=true&search=conf": "search",
+		"/?op=archive":            "archive",
+		"/-/sysinfo":              "sysinfo",
+		"/-/unknown":              "other",
+	} {
+		assert.Equal(t, name, s.handlerName(httptest.NewRequest("GET", url, nil)), url)
+	}
+	assert.Equal(t, "upload", s.handlerName(httptest.NewRequest("POST", "/", nil)))
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	defer func(m *Metrics) { metrics = m }(metrics)
+	metrics = NewMetrics()
+	s := NewHTTPStaticServer("testdata", true)
+	hdlr := s.metricsMiddleware(s)
+	for _, url := range []string{"/filetypes", "/config.yml"} {
+		hdlr.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+	buf := bytes.NewBuffer(nil)
+	metrics.WriteTo(buf)
+	assert.Contains(t, buf.String(), `ghs_http_requests_total{handler="index",method="GET",code="200"} 1`)
+	assert.Contains(t, buf.String(), `ghs_http_requests_total{handler="download",method="GET",code="200"} 1`)
+}
+
+func TestMetricsAccess(t *testing.T) {
+	get := func(h http.Handler, bearer string) int {
+		r := httptest.NewRequest("GET", "/-/metrics", nil)
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	s := NewHTTPStaticServer("testdata", true)
+	assert.Equal(t, http.StatusOK, get(s, ""))
+	s.AuthType = "http"
+	assert.Equal(t, http.StatusForbidden, get(s, ""), "only admins when login is enabled")
+
+	h := hMetricsToken("secret")
+	assert.Equal(t, http.StatusUnauthorized, get(h, ""))
+	assert.Equal(t, http.StatusUnauthorized, get(h, "wrong"))
+	assert.Equal(t, http.StatusOK, get(h, "secret"))
+}
+
+func TestMetricsWriter(t *testing.T) {
+	var w http.ResponseWriter = &metricsWriter{ResponseWriter: httptest.NewRecorder()}
+	_, ok := w.(io.ReaderFrom)
+	assert.True(t, ok, "sendfile of downloads")
+	_, ok = w.(http.Hijacker)
+	assert.True(t, ok)
+	n, err := w.(io.ReaderFrom).ReadFrom(strings.NewReader("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	assert.Equal(t, http.StatusOK, w.(*metricsWriter).status)
+}
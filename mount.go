@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Mount publishes a directory at a url path next to the files of root
+type Mount struct {
+	Prefix   string `yaml:"prefix"` // eg: /releases, only one level is supported
+	Path     string `yaml:"path"`   // the directory
+	Upload   bool   `yaml:"upload"`
+	Delete   bool   `yaml:"delete"`
+	ReadOnly bool   `yaml:"read-only"` // no upload or delete even if .ghs.yml allows
+	NoIndex  bool   `yaml:"no-index"`  // exclude from search
+}
+
+// mountInfo is a mount point listed in the root directory
+type mountInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi mountInfo) Name() string {
+	return fi.name
+}
+
+// isSubPath reports whether p is dir or inside of dir
+func isSubPath(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// mount returns the mount which relPath belongs to, nil for files of root
+func (s *HTTPStaticServer) mount(relPath string) *Mount {
+	relPath = path.Clean("/" + relPath)
+	for i, m := range s.Mounts {
+		if relPath == m.Prefix || strings.HasPrefix(relPath, m.Prefix+"/") {
+			return &s.Mounts[i]
+		}
+	}
+	return nil
+}
+
+// isMountPoint reports whether relPath is the root of a mount
+func (s *HTTPStaticServer) isMountPoint(relPath string) bool {
+	m := s.mount(relPath)
+	return m != nil && m.Prefix == path.Clean("/"+relPath)
+}
+
+// realPathOf converts path relative to root with leading / to the path on disk
+func (s *HTTPStaticServer) realPathOf(relPath string) string {
+	relPath = path.Clean("/" + relPath)
+	if m := s.mount(relPath); m != nil {
+		return filepath.ToSlash(filepath.Join(m.Path, strings.TrimPrefix(relPath, m.Prefix)))
+	}
+	return filepath.ToSlash(filepath.Join(s.Root, relPath))
+}
+
+// relativePath returns path relative to root with leading /, paths outside of root are treated as root
+func (s *HTTPStaticServer) relativePath(realPath string) string {
+	root, base := s.Root, "/"
+	for _, m := range s.Mounts {
+		if isSubPath(m.Path, realPath) && (base == "/" || len(m.Path) > len(root)) {
+			root, base = m.Path, m.Prefix
+		}
+	}
+	rel, err := filepath.Rel(root, realPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return base
+	}
+	return path.Join(base, filepath.ToSlash(rel))
+}
+
+// mountInfos returns mount points which are listed in the root directory
+func (s *HTTPStaticServer) mountInfos() []os.FileInfo {
+	infos := make([]os.FileInfo, 0, len(s.Mounts))
+	for _, m := range s.Mounts {
+		info, err := s.fs().Stat(m.Path)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, mountInfo{FileInfo: info, name: strings.TrimPrefix(m.Prefix, "/")})
+	}
+	return infos
+}
+
+// fixMounts cleans prefixes and paths of mounts
+func fixMounts(mounts []Mount) []Mount {
+	fixed := make([]Mount, len(mounts))
+	for i, m := range mounts {
+		m.Prefix = path.Clean("/" + m.Prefix)
+		m.Path = filepath.ToSlash(filepath.Clean(m.Path))
+		if m.ReadOnly {
+			m.Upload, m.Delete = false, false
+		}
+		fixed[i] = m
+	}
+	return fixed
+}
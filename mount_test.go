@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountPath(t *testing.T) {
+	s := &HTTPStaticServer{
+		Root: "/srv/www/",
+		Mounts: fixMounts([]Mount{
+			{Prefix: "releases/", Path: "/srv/releases"},
+			{Prefix: "/data", Path: "/mnt/nas/datasets/", ReadOnly: true, Upload: true},
+		}),
+	}
+	assert.Equal(t, "/releases", s.Mounts[0].Prefix)
+	assert.False(t, s.Mounts[1].Upload)
+
+	for rel, real := range map[string]string{
+		"/":                  "/srv/www",
+		"/foo.txt":           "/srv/www/foo.txt",
+		"/releases":          "/srv/releases",
+		"/releases/v1/a.zip": "/srv/releases/v1/a.zip",
+		"/releases-old":      "/srv/www/releases-old",
+		"/data/../etc":       "/srv/www/etc",
+	} {
+		assert.Equal(t, real, s.realPathOf(rel), rel)
+	}
+	for real, rel := range map[string]string{
+		"/srv/www":                   "/",
+		"/srv/www/foo.txt":           "/foo.txt",
+		"/mnt/nas/datasets/x/y.csv":  "/data/x/y.csv",
+		"/srv/releases":              "/releases",
+		"/srv":                       "/",
+		"/mnt/nas/datasets-old/x.sh": "/",
+	} {
+		assert.Equal(t, rel, s.relativePath(real), real)
+	}
+	assert.True(t, s.isMountPoint("/data"))
+	assert.False(t, s.isMountPoint("/data/x"))
+	assert.Nil(t, s.mount("/foo.txt"))
+}
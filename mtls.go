@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// newClientTLSConfig returns a tls config which verifies client certificates signed by CAs in caFile.
+// verify is one of required|optional, with optional clients without certificate are treated as guest.
+func newClientTLSConfig(caFile, verify string) (*tls.Config, error) {
+	if caFile == "" {
+		return nil, fmt.Errorf("client CA bundle is required for auth type mtls")
+	}
+	pemData, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificate found in %s", strconv.Quote(caFile))
+	}
+	cfg := &tls.Config{ClientCAs: pool}
+	switch verify {
+	case "", "required":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("invalid client verify %s, must be required or optional", strconv.Quote(verify))
+	}
+	return cfg, nil
+}
+
+// certUser returns user from the verified client certificate, SAN email is used as Email,
+// subject CN as Name (and Email when no SAN email), subject OU as Groups
+func certUser(r *http.Request) *UserInfo {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	user := &UserInfo{
+		Id:       "cert:" + cert.SerialNumber.String(),
+		Email:    cert.Subject.CommonName,
+		Name:     cert.Subject.CommonName,
+		NickName: cert.Subject.CommonName,
+		Groups:   cert.Subject.OrganizationalUnit,
+	}
+	if len(cert.EmailAddresses) > 0 {
+		user.Email = cert.EmailAddresses[0]
+	}
+	return user
+}
+
+func handleMTLS() {
+	http.HandleFunc("/-/user", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		data, _ := json.Marshal(certUser(r))
+		w.Write(data)
+	})
+}
@@ -20,14 +20,47 @@ var (
 )
 
 type UserInfo struct {
-	Id       string `json:"id"`
-	Email    string `json:"email"`
-	Name     string `json:"name"`
-	NickName string `json:"nickName"`
+	Id       string   `json:"id"`
+	Email    string   `json:"email"`
+	Name     string   `json:"name"`
+	NickName string   `json:"nickName"`
+	Groups   []string `json:"groups,omitempty"`
 }
 
 type M map[string]interface{}
 
+// currentUser returns the logged in user, nil if not logged in
+func currentUser(r *http.Request) *UserInfo {
+	if token := requestToken(r); token != nil {
+		return &UserInfo{
+			Id:    "token:" + token.ID,
+			Email: token.Owner,
+			Name:  token.Name,
+		}
+	}
+	if key := requestS3Key(r); key != nil {
+		return key.user()
+	}
+	if u := requestSFTPUser(r); u != nil {
+		return u.user()
+	}
+	switch gcfg.Auth.Type {
+	case "mtls":
+		return certUser(r)
+	case "header", "oauth2-proxy":
+		return proxyUser(r)
+	case "openid":
+	default: // the session is only set by openid login, do not trust the cookie otherwise
+		return nil
+	}
+	session, err := store.Get(r, defaultSessionName)
+	if err != nil {
+		return nil
+	}
+	userInfo, _ := session.Values["user"].(*UserInfo)
+	return userInfo
+}
+
 func init() {
 	gob.Register(&UserInfo{})
 	gob.Register(&M{})
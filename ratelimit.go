@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type RateLimitConf struct {
+	Requests      float64 `yaml:"requests"`       // requests per second of every user, or ip if not login
+	Burst         int     `yaml:"burst"`          // default to twice of requests
+	Downloads     int     `yaml:"downloads"`      // concurrent downloads per ip
+	Bandwidth     string  `yaml:"bandwidth"`      // bytes per second of all downloads, eg: 100MB
+	ConnBandwidth string  `yaml:"conn-bandwidth"` // bytes per second of every download, eg: 10MB
+}
+
+type clientLimit struct {
+	limiter   *rate.Limiter
+	downloads int
+	lastSeen  time.Time
+}
+
+// RateLimiter limits requests and downloads, nil RateLimiter limits nothing
+type RateLimiter struct {
+	conf          RateLimitConf
+	bandwidth     *rate.Limiter
+	connBandwidth int
+
+	mu      sync.Mutex
+	clients map[string]*clientLimit
+	done    chan struct{}
+}
+
+// NewRateLimiter returns nil when no limit is set
+func NewRateLimiter(conf RateLimitConf) (*RateLimiter, error) {
+	bandwidth, err := parseBandwidth(conf.Bandwidth)
+	if err != nil {
+		return nil, err
+	}
+	connBandwidth, err := parseBandwidth(conf.ConnBandwidth)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Requests < 0 || conf.Downloads < 0 {
+		return nil, fmt.Errorf("rate limit requests and downloads must not be negative")
+	}
+	if conf.Requests == 0 && conf.Downloads == 0 && bandwidth == 0 && connBandwidth == 0 {
+		return nil, nil
+	}
+	if conf.Burst <= 0 {
+		conf.Burst = int(math.Max(1, math.Ceil(conf.Requests*2)))
+	}
+	rl := &RateLimiter{
+		conf:          conf,
+		connBandwidth: connBandwidth,
+		clients:       make(map[string]*clientLimit),
+		done:          make(chan struct{}),
+	}
+	if bandwidth > 0 {
+		rl.bandwidth = rate.NewLimiter(rate.Limit(bandwidth), bandwidth)
+	}
+	go rl.cleanup()
+	return rl, nil
+}
+
+// parseBandwidth parse size like 512KB, 10MB, 1GB or bytes, empty means unlimited
+func parseBandwidth(s string) (int, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	unit := 1
+	for _, u := range []struct {
+		suffix string
+		size   int
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %s", strconv.Quote(s))
+	}
+	return int(n * float64(unit)), nil
+}
+
+func (rl *RateLimiter) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rl.done:
+			return
+		case <-ticker.C:
+		}
+		rl.mu.Lock()
+		for key, c := range rl.clients {
+			if c.downloads == 0 && time.Since(c.lastSeen) > 3*time.Minute {
+				delete(rl.clients, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// Close stops the cleanup of idle clients
+func (rl *RateLimiter) Close() {
+	if rl != nil {
+		close(rl.done)
+	}
+}
+
+func (rl *RateLimiter) client(key string) *clientLimit {
+	c, ok := rl.clients[key]
+	if !ok {
+		c = &clientLimit{limiter: rate.NewLimiter(rate.Limit(rl.conf.Requests), rl.conf.Burst)}
+		rl.clients[key] = c
+	}
+	c.lastSeen = time.Now()
+	return c
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+// Middleware limits requests per second of every user, or ip for guests
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	if rl == nil || rl.conf.Requests == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := "ip:" + remoteIP(r)
+		if user := logUser(r); user != "" {
+			key = "user:" + user
+		}
+		rl.mu.Lock()
+		reservation := rl.client(key).limiter.Reserve()
+		rl.mu.Unlock()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			tooManyRequests(w, delay, "Too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquireDownload returns false when the ip has too many downloads in progress,
+// release must be called when the download finished
+func (rl *RateLimiter) acquireDownload(r *http.Request) (release func(), ok bool) {
+	if rl == nil || rl.conf.Downloads == 0 {
+		return func() {}, true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	c := rl.client("ip:" + remoteIP(r))
+	if c.downloads >= rl.conf.Downloads {
+		return nil, false
+	}
+	c.downloads++
+	return func() {
+		rl.mu.Lock()
+		c.downloads--
+		rl.mu.Unlock()
+	}, true
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter []*rate.Limiter
+}
+
+func (w *throttledWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := len(p)
+		for _, l := range w.limiter {
+			if chunk > l.Burst() {
+				chunk = l.Burst()
+			}
+		}
+		for _, l := range w.limiter {
+			if err := l.WaitN(w.ctx, chunk); err != nil {
+				return n, err
+			}
+		}
+		written, err := w.ResponseWriter.Write(p[:chunk])
+		n += written
+		if err != nil {
+			return n, err
+		}
+		p = p[chunk:]
+	}
+	return n, nil
+}
+
+// throttle limits the bandwidth of a download
+func (rl *RateLimiter) throttle(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if rl == nil {
+		return w
+	}
+	limiter := make([]*rate.Limiter, 0, 2)
+	if rl.bandwidth != nil {
+		limiter = append(limiter, rl.bandwidth)
+	}
+	if rl.connBandwidth > 0 {
+		limiter = append(limiter, rate.NewLimiter(rate.Limit(rl.connBandwidth), rl.connBandwidth))
+	}
+	if len(limiter) == 0 {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, ctx: r.Context(), limiter: limiter}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	for s, n := range map[string]int{"": 0, "512": 512, "512KB": 512 << 10, "10MB": 10 << 20, "1.5g": 3 << 29} {
+		v, err := parseBandwidth(s)
+		assert.NoError(t, err)
+		assert.Equal(t, n, v, s)
+	}
+	_, err := parseBandwidth("fast")
+	assert.Error(t, err)
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl, err := NewRateLimiter(RateLimitConf{})
+	assert.NoError(t, err)
+	assert.Nil(t, rl)
+
+	rl, err = NewRateLimiter(RateLimitConf{Requests: 1, Burst: 2, Downloads: 1})
+	assert.NoError(t, err)
+	hdlr := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	codes := make([]int, 0)
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		hdlr.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		codes = append(codes, w.Code)
+		if w.Code == http.StatusTooManyRequests {
+			assert.Equal(t, "1", w.Header().Get("Retry-After"))
+		}
+	}
+	assert.Equal(t, []int{200, 200, 429}, codes)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	release, ok := rl.acquireDownload(r)
+	assert.True(t, ok)
+	_, ok = rl.acquireDownload(r)
+	assert.False(t, ok)
+	release()
+	_, ok = rl.acquireDownload(r)
+	assert.True(t, ok)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// cfgMu guards fields of gcfg which are changed by config reload
+var cfgMu sync.RWMutex
+
+// config keys which can be changed without restart
+var reloadableKeys = []string{"title", "theme", "google-tracker-id", "upload", "delete",
+	"auth.http", "groups", "admins", "cors", "rate-limit"}
+
+type handlerBox struct {
+	http.Handler
+}
+
+type reloadHandler struct {
+	next       http.Handler
+	middleware func(next http.Handler) http.Handler
+	h          atomic.Value // handlerBox
+}
+
+var reloadHandlers []*reloadHandler
+
+// reloadable wraps next with middleware built from the config, it is built again after config reload
+func reloadable(next http.Handler, middleware func(next http.Handler) http.Handler) http.Handler {
+	rh := &reloadHandler{next: next, middleware: middleware}
+	rh.rebuild()
+	reloadHandlers = append(reloadHandlers, rh)
+	return rh
+}
+
+func (rh *reloadHandler) rebuild() {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	rh.h.Store(handlerBox{rh.middleware(rh.next)})
+}
+
+func (rh *reloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rh.h.Load().(handlerBox).ServeHTTP(w, r)
+}
+
+// configDiff returns yaml keys of the fields which are different, fields of auth are compared one by one
+func configDiff(a, b *Configure) []string {
+	var diff []string
+	var compare func(prefix string, va, vb reflect.Value)
+	compare = func(prefix string, va, vb reflect.Value) {
+		t := va.Type()
+		for i := 0; i < t.NumField(); i++ {
+			key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			if key == "-" || key == "" {
+				continue
+			}
+			if prefix == "" && key == "auth" {
+				compare("auth.", va.Field(i), vb.Field(i))
+				continue
+			}
+			if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+				diff = append(diff, prefix+key)
+			}
+		}
+	}
+	compare("", reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem())
+	return diff
+}
+
+// reloadConfig reads the config again and applies the changes which do not require restart,
+// the running config is kept if the new one is invalid
+func reloadConfig(ss *HTTPStaticServer) error {
+	var cfg Configure
+	if _, err := readConfig(&cfg); err != nil {
+		return err
+	}
+	if errs := validateConfig(&cfg); len(errs) > 0 {
+		return errs
+	}
+	cfg.Prefix = fixPrefix(cfg.Prefix)
+	cfg.Addr = fixAddr(cfg.Addr, cfg.Port)
+
+	cfgMu.RLock()
+	old := gcfg
+	cfgMu.RUnlock()
+	var changed []string
+	for _, key := range configDiff(&old, &cfg) {
+		if stringInSlice(key, reloadableKeys) {
+			changed = append(changed, key)
+		} else {
+			log.Printf("config reload: %s changed, restart required to apply it", key)
+		}
+	}
+	if len(changed) == 0 {
+		log.Println("config reload: nothing changed")
+		return nil
+	}
+
+	oldLimiter := ss.limiter()
+	limiter := oldLimiter
+	if stringInSlice("rate-limit", changed) {
+		var err error
+		if limiter, err = NewRateLimiter(cfg.RateLimit); err != nil {
+			return err
+		}
+	}
+
+	cfgMu.Lock()
+	gcfg.Title = cfg.Title
+	gcfg.Theme = cfg.Theme
+	gcfg.GoogleTrackerID = cfg.GoogleTrackerID
+	gcfg.Upload = cfg.Upload
+	gcfg.Delete = cfg.Delete
+	gcfg.Auth.HTTP = cfg.Auth.HTTP
+	gcfg.Groups = cfg.Groups
+	gcfg.Admins = cfg.Admins
+	gcfg.CORS = cfg.CORS
+	gcfg.RateLimit = cfg.RateLimit
+	cfgMu.Unlock()
+
+	ss.mu.Lock()
+	ss.Title = cfg.Title
+	ss.Theme = cfg.Theme
+	ss.GoogleTrackerID = cfg.GoogleTrackerID
+	ss.Upload = cfg.Upload
+	ss.Delete = cfg.Delete
+	ss.Limiter = limiter
+	ss.mu.Unlock()
+	ss.acl.invalidate()
+
+	for _, rh := range reloadHandlers {
+		rh.rebuild()
+	}
+	if limiter != oldLimiter {
+		oldLimiter.Close()
+	}
+	log.Printf("config reloaded, changed: %s", strings.Join(changed, ", "))
+	return nil
+}
+
+func multiBasicAuthFromConfig(next http.Handler) http.Handler {
+	return multiBasicAuth(gcfg.Auth.HTTP)(next)
+}
+
+func fileModTime(filename string) time.Time {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// watchConfig reloads config when the file is modified or SIGHUP is received
+func watchConfig(ss *HTTPStaticServer, filename string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	modTime := fileModTime(filename)
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+			log.Println("SIGHUP received, reload config")
+		case <-ticker.C:
+			if t := fileModTime(filename); t.IsZero() || t.Equal(modTime) {
+				continue
+			}
+			log.Printf("%s modified, reload config", filename)
+		}
+		modTime = fileModTime(filename)
+		if err := reloadConfig(ss); err != nil {
+			log.Printf("config reload failed, keep running with the old config: %v", err)
+		}
+	}
+}
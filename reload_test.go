@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigDiff(t *testing.T) {
+	a := Configure{Title: "a", Port: 8000}
+	a.Auth.Type = "http"
+	b := a
+	assert.Empty(t, configDiff(&a, &b))
+
+	b.Title = "b"
+	b.Port = 8001
+	b.Auth.HTTP = []string{"user:pass"}
+	b.CORS.Enabled = true
+	assert.Equal(t, []string{"port", "title", "auth.http", "cors"}, configDiff(&a, &b))
+}
+
+func TestReloadable(t *testing.T) {
+	title := "first"
+	hdlr := reloadable(http.NotFoundHandler(), func(next http.Handler) http.Handler {
+		name := title
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	})
+	defer func() { reloadHandlers = nil }()
+
+	w := httptest.NewRecorder()
+	hdlr.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "first", w.Body.String())
+
+	title = "second"
+	for _, rh := range reloadHandlers {
+		rh.rebuild()
+	}
+	w = httptest.NewRecorder()
+	hdlr.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "second", w.Body.String())
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RotateWriter appends to Filename, when the file grows over MaxSize or a new Interval begins
+// it is renamed to Filename.1 (older ones to Filename.2, ...) and at most MaxBackups old files are kept
+type RotateWriter struct {
+	Filename   string
+	MaxSize    int64         // bytes, 0 means never rotate by size
+	Interval   time.Duration // eg: 24h, 0 means never rotate by time
+	MaxBackups int
+
+	mu       sync.Mutex
+	file     *os.File // nil if closed or the new file of the last rotation failed to open
+	closed   bool
+	size     int64
+	openedAt time.Time
+}
+
+func NewRotateWriter(filename string, maxSize int64, maxBackups int) (*RotateWriter, error) {
+	w := &RotateWriter{
+		Filename:   filename,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotateWriter) open() error {
+	if dir := filepath.Dir(w.Filename); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(w.Filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size, w.openedAt = f, info.Size(), info.ModTime()
+	return nil
+}
+
+// backupName returns name of the n-th old file, 0 is the current file
+func (w *RotateWriter) backupName(n int) string {
+	if n == 0 {
+		return w.Filename
+	}
+	return fmt.Sprintf("%s.%d", w.Filename, n)
+}
+
+// rotate shifts the old files, if the new file fails to open it is opened again on the next
+// write without shifting, so the backups are not removed one by one
+func (w *RotateWriter) rotate() error {
+	w.file.Close()
+	w.file, w.size = nil, 0
+	os.Remove(w.backupName(w.MaxBackups))
+	for n := w.MaxBackups - 1; n >= 0; n-- {
+		os.Rename(w.backupName(n), w.backupName(n+1))
+	}
+	if w.MaxBackups <= 0 {
+		os.Remove(w.Filename)
+	}
+	return w.open()
+}
+
+func (w *RotateWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	if w.size > 0 && (w.MaxSize > 0 && w.size+int64(len(p)) > w.MaxSize ||
+		w.Interval > 0 && !time.Now().Truncate(w.Interval).Equal(w.openedAt.Truncate(w.Interval))) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Files returns existing log files, oldest first
+func (w *RotateWriter) Files() []string {
+	files := make([]string, 0, w.MaxBackups+1)
+	for n := w.MaxBackups; n >= 0; n-- {
+		if name := w.backupName(n); fileExists(name) {
+			files = append(files, name)
+		}
+	}
+	return files
+}
+
+func (w *RotateWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
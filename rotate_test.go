@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotateWriterOpenFailure(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	w, err := NewRotateWriter(filename, 4, 2)
+	assert.Nil(t, err)
+	_, err = w.Write([]byte("old\n"))
+	assert.Nil(t, err)
+
+	// the new file can not be created, eg: disk full or permission denied
+	assert.Nil(t, os.MkdirAll(filepath.Join(filename+".1", "x"), 0755))
+	assert.Nil(t, os.MkdirAll(filepath.Join(filename+".2", "x"), 0755))
+	assert.Nil(t, os.Remove(filename))
+	assert.Nil(t, os.MkdirAll(filepath.Join(filename, "x"), 0755))
+	_, err = w.Write([]byte("new\n"))
+	assert.NotNil(t, err)
+	assert.Nil(t, w.file)
+	assert.Equal(t, int64(0), w.size) // not rotated again by the next write
+	_, err = w.Write([]byte("new\n"))
+	assert.NotNil(t, err)
+
+	// opened again without another rotation
+	assert.Nil(t, os.RemoveAll(filename))
+	_, err = w.Write([]byte("new\n"))
+	assert.Nil(t, err)
+	data, _ := ioutil.ReadFile(filename)
+	assert.Equal(t, "new\n", string(data))
+	assert.True(t, isDir(filename+".1"))
+
+	assert.Nil(t, w.Close())
+	_, err = w.Write([]byte("closed\n"))
+	assert.Equal(t, os.ErrClosed, err)
+}
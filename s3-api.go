@@ -0,0 +1,1149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3APIConf serves the files as a bucket of the S3 REST API on a separate listener
+type S3APIConf struct {
+	Addr   string  `yaml:"addr"`   // eg: :9000, the api is disabled if empty
+	Bucket string  `yaml:"bucket"` // name of the only bucket, default ghs
+	Region string  `yaml:"region"` // default us-east-1
+	Keys   []S3Key `yaml:"keys"`
+}
+
+// S3Key is an access key of the S3 API, .ghs.yml rules of the user Email apply to its requests
+type S3Key struct {
+	AccessKey string   `yaml:"access-key"`
+	SecretKey string   `yaml:"secret-key"`
+	Email     string   `yaml:"email"`
+	Groups    []string `yaml:"groups"`
+}
+
+func (k *S3Key) user() *UserInfo {
+	return &UserInfo{
+		Id:     "s3:" + k.AccessKey,
+		Email:  k.Email,
+		Name:   k.AccessKey,
+		Groups: k.Groups,
+	}
+}
+
+const (
+	s3Namespace     = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TempPrefix    = ".ghs-upload-" // objects are written to a temporary file and renamed
+	s3MaxKeys       = 1000
+	s3MaxClockSkew  = 15 * time.Minute
+	s3UploadExpires = 24 * time.Hour
+	s3MaxChunkSize  = 16 << 20
+)
+
+// subresources of buckets and objects which are not supported
+var s3Unsupported = []string{"acl", "attributes", "cors", "legal-hold", "lifecycle", "logging", "notification",
+	"object-lock", "policy", "replication", "restore", "retention", "select", "tagging", "torrent", "versioning",
+	"versions", "website"}
+
+// S3API serves HTTPStaticServer.Root as a single bucket. Only the files are objects,
+// directories appear as common prefixes and .ghs.yml is never listed or written.
+type S3API struct {
+	s       *HTTPStaticServer
+	conf    S3APIConf
+	mu      sync.Mutex
+	uploads map[string]*s3Upload // upload id -> multipart upload in progress
+}
+
+// s3Upload is a multipart upload, parts are kept in dir until it is completed
+type s3Upload struct {
+	key       string
+	accessKey string
+	dir       string
+	created   time.Time
+	parts     map[int]string // part number -> md5 hex
+}
+
+func NewS3API(s *HTTPStaticServer, conf S3APIConf) *S3API {
+	if conf.Bucket == "" {
+		conf.Bucket = "ghs"
+	}
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+	return &S3API{s: s, conf: conf, uploads: make(map[string]*s3Upload)}
+}
+
+// s3APIError is the error response of the S3 API
+type s3APIError struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+	status   int
+}
+
+func (e *s3APIError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func s3Err(status int, code, message string) *s3APIError {
+	return &s3APIError{Code: code, Message: message, status: status}
+}
+
+func writeS3XML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	e, ok := err.(*s3APIError)
+	if !ok {
+		log.Println("S3 API:", err)
+		e = s3Err(http.StatusInternalServerError, "InternalError", "We encountered an internal error, please try again.")
+	}
+	resp := *e
+	resp.Resource = r.URL.Path
+	writeS3XML(w, resp.status, &resp)
+}
+
+// s3Auth is the verified signature of a request, chunk signatures of the body are chained from it
+type s3Auth struct {
+	key         *S3Key
+	amzDate     string
+	scope       string
+	signingKey  []byte
+	signature   string
+	payloadHash string
+}
+
+// requestS3Key returns the access key which signed the request of the S3 API
+func requestS3Key(r *http.Request) *S3Key {
+	if a, ok := r.Context().Value(ctxKeyS3).(*s3Auth); ok {
+		return a.key
+	}
+	return nil
+}
+
+func (api *S3API) accessKey(id string) *S3Key {
+	for i := range api.conf.Keys {
+		if api.conf.Keys[i].AccessKey == id {
+			return &api.conf.Keys[i]
+		}
+	}
+	return nil
+}
+
+// authenticate verifies the signature version 4 of the Authorization header or the presigned url
+func (api *S3API) authenticate(r *http.Request) (*s3Auth, error) {
+	query := r.URL.Query()
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	authorization := r.Header.Get("Authorization")
+	presigned := query.Get("X-Amz-Algorithm") != ""
+	switch {
+	case strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 "):
+		for _, field := range strings.Split(strings.TrimPrefix(authorization, "AWS4-HMAC-SHA256 "), ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				signedHeaders = kv[1]
+			case "Signature":
+				signature = kv[1]
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			return nil, s3Err(http.StatusBadRequest, "InvalidRequest", "Missing required header x-amz-content-sha256")
+		}
+	case presigned:
+		if query.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" {
+			return nil, s3Err(http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Algorithm only supports AWS4-HMAC-SHA256")
+		}
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = "UNSIGNED-PAYLOAD"
+	case authorization == "":
+		return nil, s3Err(http.StatusForbidden, "AccessDenied", "Anonymous access is not allowed")
+	default:
+		return nil, s3Err(http.StatusBadRequest, "InvalidRequest", "Only AWS4-HMAC-SHA256 signature is supported")
+	}
+
+	t, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return nil, s3Err(http.StatusForbidden, "AccessDenied", "X-Amz-Date is missing or invalid")
+	}
+	if presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 1 || expires > 7*24*3600 {
+			return nil, s3Err(http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be between 1 and 604800 seconds")
+		}
+		if time.Now().After(t.Add(time.Duration(expires) * time.Second)) {
+			return nil, s3Err(http.StatusForbidden, "AccessDenied", "Request has expired")
+		}
+	} else if d := time.Since(t); d > s3MaxClockSkew || d < -s3MaxClockSkew {
+		return nil, s3Err(http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large")
+	}
+	if payloadHash != "UNSIGNED-PAYLOAD" && !strings.HasPrefix(payloadHash, "STREAMING-") {
+		if b, err := hex.DecodeString(payloadHash); err != nil || len(b) != sha256.Size {
+			return nil, s3Err(http.StatusBadRequest, "InvalidArgument", "x-amz-content-sha256 must be UNSIGNED-PAYLOAD, STREAMING-* or a hex sha256")
+		}
+	}
+
+	// access-key/date/region/s3/aws4_request
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[1] != amzDate[:8] || parts[3] != "s3" || parts[4] != "aws4_request" {
+		return nil, s3Err(http.StatusBadRequest, "AuthorizationHeaderMalformed", "The credential is malformed")
+	}
+	if !stringInSlice("host", strings.Split(signedHeaders, ";")) {
+		return nil, s3Err(http.StatusBadRequest, "AuthorizationHeaderMalformed", "The host header must be signed")
+	}
+	key := api.accessKey(parts[0])
+	if key == nil {
+		return nil, s3Err(http.StatusForbidden, "InvalidAccessKeyId", "The access key Id you provided does not exist in our records")
+	}
+
+	var headers strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = strconv.FormatInt(r.ContentLength, 10)
+		default:
+			value = strings.Join(r.Header[http.CanonicalHeaderKey(name)], ",")
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	query.Del("X-Amz-Signature")
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		s3Escape(r.URL.Path, true),
+		s3Query(query),
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	a := &s3Auth{
+		key:         key,
+		amzDate:     amzDate,
+		scope:       strings.Join(parts[1:], "/"),
+		signingKey:  sigV4Key(key.SecretKey, parts[1], parts[2]),
+		payloadHash: payloadHash,
+	}
+	a.signature = sigV4Sign(a.signingKey, amzDate, a.scope, canonicalRequest)
+	if !hmac.Equal([]byte(a.signature), []byte(signature)) {
+		return nil, s3Err(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided")
+	}
+	return a, nil
+}
+
+// payload returns the body of the request, which is verified against the signature while reading
+func (a *s3Auth) payload(r *http.Request) io.Reader {
+	switch {
+	case a.payloadHash == "UNSIGNED-PAYLOAD":
+		return r.Body
+	case strings.HasPrefix(a.payloadHash, "STREAMING-"):
+		return &s3ChunkedReader{
+			r:      bufio.NewReader(r.Body),
+			auth:   a,
+			prev:   a.signature,
+			verify: strings.HasPrefix(a.payloadHash, "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"),
+		}
+	default:
+		return &s3HashReader{r: r.Body, hash: sha256.New(), sum: a.payloadHash}
+	}
+}
+
+var errS3ContentSHA256 = s3Err(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed")
+
+// s3HashReader returns error at the end if the content does not match sum
+type s3HashReader struct {
+	r    io.Reader
+	hash hash.Hash
+	sum  string
+}
+
+func (h *s3HashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(h.hash.Sum(nil)) != h.sum {
+		err = errS3ContentSHA256
+	}
+	return n, err
+}
+
+var errS3Chunk = s3Err(http.StatusBadRequest, "IncompleteBody", "The aws-chunked body is malformed")
+
+// s3ChunkedReader decodes the aws-chunked body, chunk signatures are checked when verify is true.
+// Trailers after the last chunk are skipped without verification.
+type s3ChunkedReader struct {
+	r      *bufio.Reader
+	auth   *s3Auth
+	prev   string // signature of the previous chunk
+	verify bool
+	chunk  []byte
+	done   bool
+}
+
+func (c *s3ChunkedReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+// next reads a chunk like: hex-size;chunk-signature=signature\r\ndata\r\n
+func (c *s3ChunkedReader) next() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return errS3Chunk
+	}
+	fields := strings.SplitN(strings.TrimRight(line, "\r\n"), ";", 2)
+	size, err := strconv.ParseInt(fields[0], 16, 64)
+	if err != nil || size < 0 || size > s3MaxChunkSize {
+		return errS3Chunk
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return errS3Chunk
+	}
+	if c.verify {
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "chunk-signature=") {
+			return errS3Chunk
+		}
+		digest := sha256.Sum256(data)
+		stringToSign := "AWS4-HMAC-SHA256-PAYLOAD\n" + c.auth.amzDate + "\n" + c.auth.scope + "\n" +
+			c.prev + "\n" + emptySHA256 + "\n" + hex.EncodeToString(digest[:])
+		signature := hex.EncodeToString(hmacSHA256(c.auth.signingKey, stringToSign))
+		if !hmac.Equal([]byte(signature), []byte(strings.TrimPrefix(fields[1], "chunk-signature="))) {
+			return s3Err(http.StatusForbidden, "SignatureDoesNotMatch", "The chunk signature does not match")
+		}
+		c.prev = signature
+	}
+	if size == 0 {
+		c.done = true
+		for { // trailers end with an empty line
+			line, err := c.r.ReadString('\n')
+			if strings.TrimRight(line, "\r\n") == "" || err != nil {
+				return nil
+			}
+		}
+	}
+	if crlf, err := c.r.ReadString('\n'); err != nil || crlf != "\r\n" {
+		return errS3Chunk
+	}
+	c.chunk = data
+	return nil
+}
+
+// Handler authenticates the requests, wrap adds the middlewares which need the user like the access log
+func (api *S3API) Handler(wrap func(http.Handler) http.Handler) http.Handler {
+	var next http.Handler = http.HandlerFunc(api.serve)
+	if wrap != nil {
+		next = wrap(next)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a, err := api.authenticate(r)
+		if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyS3, a)))
+	})
+}
+
+func (api *S3API) serve(w http.ResponseWriter, r *http.Request) {
+	// the body is the object, keep FormValue of the permission checks from parsing it
+	r.Form, r.PostForm = r.URL.Query(), url.Values{}
+	query := r.URL.Query()
+	bucket, key := r.URL.Path, ""
+	if i := strings.Index(bucket[1:], "/"); i >= 0 {
+		bucket, key = bucket[1:i+1], bucket[i+2:]
+	} else {
+		bucket = bucket[1:]
+	}
+	for _, name := range s3Unsupported {
+		if _, ok := query[name]; ok {
+			writeS3Error(w, r, s3Err(http.StatusNotImplemented, "NotImplemented", "The "+name+" subresource is not supported"))
+			return
+		}
+	}
+	_, uploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+	_, del := query["delete"]
+	_, location := query["location"]
+
+	if bucket == "" {
+		if r.Method == "GET" {
+			api.listBuckets(w, r)
+			return
+		}
+		writeS3Error(w, r, s3Err(http.StatusNotImplemented, "NotImplemented", "Only ListBuckets is supported on the service"))
+		return
+	}
+	if bucket != api.conf.Bucket {
+		writeS3Error(w, r, s3Err(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"))
+		return
+	}
+
+	var err error
+	switch {
+	case key == "" && r.Method == "HEAD":
+	case key == "" && r.Method == "GET" && location:
+		api.bucketLocation(w)
+	case key == "" && r.Method == "GET" && !uploads:
+		err = api.listObjects(w, r, query)
+	case key == "" && r.Method == "POST" && del:
+		err = api.deleteObjects(w, r)
+	case key == "":
+		err = s3Err(http.StatusNotImplemented, "NotImplemented", "The bucket operation is not supported")
+	case (r.Method == "GET" || r.Method == "HEAD") && uploadID == "":
+		err = api.getObject(w, r, key)
+	case r.Method == "PUT" && uploadID != "" && r.Header.Get("X-Amz-Copy-Source") == "":
+		err = api.uploadPart(w, r, key, uploadID)
+	case r.Method == "PUT" && uploadID == "" && r.Header.Get("X-Amz-Copy-Source") != "":
+		err = api.copyObject(w, r, key)
+	case r.Method == "PUT" && uploadID == "":
+		err = api.putObject(w, r, key)
+	case r.Method == "POST" && uploads:
+		err = api.createUpload(w, r, key)
+	case r.Method == "POST" && uploadID != "":
+		err = api.completeUpload(w, r, key, uploadID)
+	case r.Method == "DELETE" && uploadID != "":
+		err = api.abortUpload(w, r, key, uploadID)
+	case r.Method == "DELETE":
+		if err = api.deleteObject(r, key); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		err = s3Err(http.StatusNotImplemented, "NotImplemented", "The object operation is not supported")
+	}
+	if err != nil {
+		writeS3Error(w, r, err)
+	}
+}
+
+// keyPath converts key to the path relative to root, keys which are not clean paths are refused
+func keyPath(key string) (string, error) {
+	relPath := path.Clean("/" + key)
+	if key == "" || relPath != "/"+strings.TrimSuffix(key, "/") || relPath == "/" {
+		return "", s3Err(http.StatusBadRequest, "InvalidArgument", "Key must be a clean path without . or .. or //")
+	}
+	return relPath, nil
+}
+
+// denied logs the audit entry and returns the error shown to the client
+func (api *S3API) denied(entry *AuditEntry, auth *AccessConf) error {
+	entry.Allowed = false
+	api.s.Audit.Log(entry)
+	if auth.DenyStatus == http.StatusNotFound {
+		return s3Err(http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	}
+	return s3Err(http.StatusForbidden, "AccessDenied", "Access Denied")
+}
+
+// s3ETag returns the ETag of a stored file. The md5 of the content is unknown,
+// so it is made from the modification time and size in the format of multipart uploads.
+func s3ETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%d"`, info.ModTime().UnixNano(), info.Size())
+}
+
+func (api *S3API) getObject(w http.ResponseWriter, r *http.Request, key string) error {
+	s := api.s
+	relPath, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+	realPath := s.realPathOf(relPath)
+	auth := s.readAccessConf(realPath)
+	if !auth.canRead(r) {
+		return api.denied(newAuditEntry(r, &auth, AuditRead, false), &auth)
+	}
+	info, err := s.fs().Stat(realPath)
+	if err != nil || !info.Mode().IsRegular() || strings.HasSuffix(key, "/") || path.Base(relPath) == YAMLCONF {
+		return s3Err(http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	}
+	w.Header().Set("ETag", s3ETag(info))
+	for name, header := range map[string]string{
+		"response-content-type":        "Content-Type",
+		"response-content-disposition": "Content-Disposition",
+		"response-content-encoding":    "Content-Encoding",
+		"response-content-language":    "Content-Language",
+		"response-cache-control":       "Cache-Control",
+		"response-expires":             "Expires",
+	} {
+		if v := r.URL.Query().Get(name); v != "" {
+			w.Header().Set(header, v)
+		}
+	}
+	s.serveFile(w, r, realPath)
+	return nil
+}
+
+// writeAccess checks whether relPath can be created or replaced by the request
+func (api *S3API) writeAccess(r *http.Request, relPath, op string) (*AuditEntry, error) {
+	s := api.s
+	if err := checkFilename(path.Base(relPath)); err != nil {
+		return nil, s3Err(http.StatusBadRequest, "InvalidArgument", err.Error())
+	}
+	auth := s.readAccessConf(s.realPathOf(path.Dir(relPath)))
+	entry := newAuditEntry(r, &auth, op, true)
+	entry.Path = relPath
+	if path.Base(relPath) == YAMLCONF || s.isMountPoint(relPath) || !auth.canUpload(r) || !auth.writable(r, relPath) {
+		return entry, api.denied(entry, &auth)
+	}
+	if s.isDir(s.realPathOf(relPath)) && op != AuditMkdir {
+		return entry, s3Err(http.StatusConflict, "InvalidRequest", "A directory exists at the key")
+	}
+	return entry, nil
+}
+
+// writeObject saves body to realPath through a temporary file, md5 hex of the content is returned.
+// contentMD5 is the base64 md5 the content must match, skipped if empty.
+func (api *S3API) writeObject(realPath string, body io.Reader, contentMD5 string, entry *AuditEntry) (string, error) {
+	s := api.s
+	if err := s.fs().MkdirAll(path.Dir(realPath)); err != nil {
+		return "", err
+	}
+	tmpPath := path.Join(path.Dir(realPath), s3TempPrefix+randomHex(8))
+	dst, err := s.fs().Create(tmpPath, true)
+	if err != nil {
+		return "", err
+	}
+	buf := s.bufPool.Get().([]byte)
+	defer s.bufPool.Put(buf)
+	md5sum, sha := md5.New(), sha256.New()
+	entry.Size, err = io.CopyBuffer(io.MultiWriter(dst, md5sum, sha), body, buf)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && contentMD5 != "" && contentMD5 != base64.StdEncoding.EncodeToString(md5sum.Sum(nil)) {
+		err = s3Err(http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received")
+	}
+	if err == nil {
+		err = s.fs().Rename(tmpPath, realPath)
+	}
+	if err != nil {
+		s.fs().RemoveAll(tmpPath)
+		entry.Error = err.Error()
+		s.Audit.Log(entry)
+		return "", err
+	}
+	entry.Digest = "sha256:" + hex.EncodeToString(sha.Sum(nil))
+	s.Audit.Log(entry)
+	return hex.EncodeToString(md5sum.Sum(nil)), nil
+}
+
+func (api *S3API) putObject(w http.ResponseWriter, r *http.Request, key string) error {
+	s := api.s
+	relPath, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+	realPath := s.realPathOf(relPath)
+	a := r.Context().Value(ctxKeyS3).(*s3Auth)
+	if strings.HasSuffix(key, "/") { // folder object
+		entry, err := api.writeAccess(r, relPath, AuditMkdir)
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, a.payload(r))
+		if err := s.fs().MkdirAll(realPath); err != nil {
+			return err
+		}
+		s.Audit.Log(entry)
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`) // md5 of empty content
+		return nil
+	}
+	entry, err := api.writeAccess(r, relPath, AuditUpload)
+	if err != nil {
+		return err
+	}
+	if r.Header.Get("If-None-Match") == "*" && s.isFile(realPath) {
+		return s3Err(http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+	}
+	etag, err := api.writeObject(realPath, a.payload(r), r.Header.Get("Content-MD5"), entry)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	return nil
+}
+
+type s3CopyResult struct {
+	XMLName      xml.Name  `xml:"CopyObjectResult"`
+	Xmlns        string    `xml:"xmlns,attr"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+}
+
+func (api *S3API) copyObject(w http.ResponseWriter, r *http.Request, key string) error {
+	s := api.s
+	relPath, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+	source := strings.SplitN(r.Header.Get("X-Amz-Copy-Source"), "?", 2)[0] // versionId is ignored
+	source, err = url.PathUnescape(strings.TrimPrefix(source, "/"))
+	parts := strings.SplitN(source, "/", 2)
+	if err != nil || len(parts) != 2 {
+		return s3Err(http.StatusBadRequest, "InvalidArgument", "x-amz-copy-source must be bucket/key")
+	}
+	if parts[0] != api.conf.Bucket {
+		return s3Err(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+	}
+	srcPath, err := keyPath(parts[1])
+	if err != nil {
+		return err
+	}
+	srcReal := s.realPathOf(srcPath)
+	srcAuth := s.readAccessConf(srcReal)
+	if path.Base(srcPath) == YAMLCONF || !srcAuth.canRead(r) {
+		return api.denied(newAuditEntry(r, &srcAuth, AuditRead, false), &srcAuth)
+	}
+	entry, err := api.writeAccess(r, relPath, AuditUpload)
+	if err != nil {
+		return err
+	}
+	src, err := s.fs().Open(srcReal)
+	if err != nil {
+		return s3Err(http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	}
+	defer src.Close()
+	if info, err := src.Stat(); err != nil || info.IsDir() {
+		return s3Err(http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	}
+	etag, err := api.writeObject(s.realPathOf(relPath), src, "", entry)
+	if err != nil {
+		return err
+	}
+	writeS3XML(w, http.StatusOK, &s3CopyResult{Xmlns: s3Namespace, LastModified: time.Now().UTC(), ETag: `"` + etag + `"`})
+	return nil
+}
+
+// deleteObject removes the file of key, a directory is only removed by its folder key when it is empty.
+// Keys which do not exist are deleted successfully like S3.
+func (api *S3API) deleteObject(r *http.Request, key string) error {
+	s := api.s
+	relPath, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+	realPath := s.realPathOf(relPath)
+	auth := s.readAccessConf(realPath)
+	entry := newAuditEntry(r, &auth, AuditDelete, true)
+	if path.Base(relPath) == YAMLCONF || !auth.canDelete(r) || s.isMountPoint(relPath) {
+		return api.denied(entry, &auth)
+	}
+	info, err := s.fs().Stat(realPath)
+	if err != nil || info.IsDir() != strings.HasSuffix(key, "/") {
+		return nil
+	}
+	if info.IsDir() {
+		if infos, err := s.fs().ReadDir(realPath); err != nil || len(infos) > 0 {
+			return nil
+		}
+	}
+	err = s.fs().RemoveAll(realPath)
+	if err != nil {
+		entry.Error = err.Error()
+	} else if err := s.Stats.Remove(relPath); err != nil {
+		log.Println("Remove download stats:", err)
+	}
+	s.Audit.Log(entry)
+	return err
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Deleted []struct {
+		Key string `xml:"Key"`
+	} `xml:"Deleted"`
+	Errors []s3DeleteError `xml:"Error"`
+}
+
+type s3DeleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (api *S3API) deleteObjects(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Quiet   bool `xml:"Quiet"`
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	a := r.Context().Value(ctxKeyS3).(*s3Auth)
+	if err := xml.NewDecoder(io.LimitReader(a.payload(r), 2<<20)).Decode(&req); err != nil || len(req.Objects) > 1000 {
+		if e, ok := err.(*s3APIError); ok {
+			return e
+		}
+		return s3Err(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema")
+	}
+	result := &s3DeleteResult{Xmlns: s3Namespace}
+	for _, obj := range req.Objects {
+		if err := api.deleteObject(r, obj.Key); err != nil {
+			e, ok := err.(*s3APIError)
+			if !ok {
+				e = s3Err(http.StatusInternalServerError, "InternalError", err.Error())
+			}
+			result.Errors = append(result.Errors, s3DeleteError{Key: obj.Key, Code: e.Code, Message: e.Message})
+		} else if !req.Quiet {
+			result.Deleted = append(result.Deleted, struct {
+				Key string `xml:"Key"`
+			}{obj.Key})
+		}
+	}
+	writeS3XML(w, http.StatusOK, result)
+	return nil
+}
+
+type s3Bucket struct {
+	Name         string    `xml:"Name"`
+	CreationDate time.Time `xml:"CreationDate"`
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+func (api *S3API) listBuckets(w http.ResponseWriter, r *http.Request) {
+	created := time.Now()
+	if info, err := api.s.fs().Stat(api.s.realPathOf("/")); err == nil {
+		created = info.ModTime()
+	}
+	key := requestS3Key(r)
+	writeS3XML(w, http.StatusOK, &s3ListBucketsResult{
+		Xmlns:   s3Namespace,
+		Owner:   s3Owner{ID: key.AccessKey, DisplayName: key.Email},
+		Buckets: []s3Bucket{{Name: api.conf.Bucket, CreationDate: created.UTC()}},
+	})
+}
+
+func (api *S3API) bucketLocation(w http.ResponseWriter) {
+	location := api.conf.Region
+	if location == "us-east-1" {
+		location = ""
+	}
+	writeS3XML(w, http.StatusOK, &struct {
+		XMLName  xml.Name `xml:"LocationConstraint"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string   `xml:",chardata"`
+	}{Xmlns: s3Namespace, Location: location})
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name   `xml:"ListBucketResult"`
+	Xmlns                 string     `xml:"xmlns,attr"`
+	Name                  string     `xml:"Name"`
+	Prefix                string     `xml:"Prefix"`
+	Delimiter             string     `xml:"Delimiter,omitempty"`
+	MaxKeys               int        `xml:"MaxKeys"`
+	EncodingType          string     `xml:"EncodingType,omitempty"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	Marker                *string    `xml:"Marker"`
+	NextMarker            string     `xml:"NextMarker,omitempty"`
+	KeyCount              *int       `xml:"KeyCount"`
+	ContinuationToken     string     `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string     `xml:"StartAfter,omitempty"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// listObjects is ListObjectsV2 if list-type is 2, ListObjects otherwise
+func (api *S3API) listObjects(w http.ResponseWriter, r *http.Request, query url.Values) error {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	if delimiter != "" && delimiter != "/" {
+		return s3Err(http.StatusBadRequest, "InvalidArgument", "Only / is supported as the delimiter")
+	}
+	maxKeys := s3MaxKeys
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return s3Err(http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer")
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	encode := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		encode = url.QueryEscape
+	}
+
+	result := &s3ListBucketResult{
+		Xmlns:        s3Namespace,
+		Name:         api.conf.Bucket,
+		Prefix:       encode(prefix),
+		Delimiter:    encode(delimiter),
+		MaxKeys:      maxKeys,
+		EncodingType: query.Get("encoding-type"),
+	}
+	v2 := query.Get("list-type") == "2"
+	marker := query.Get("marker")
+	if v2 {
+		marker = query.Get("start-after")
+		result.StartAfter = encode(marker)
+		if token := query.Get("continuation-token"); token != "" {
+			data, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return s3Err(http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect")
+			}
+			result.ContinuationToken, marker = token, string(data)
+		}
+	} else {
+		encoded := encode(marker)
+		result.Marker = &encoded
+	}
+
+	entries, truncated := api.list(r, prefix, delimiter, marker, maxKeys)
+	for _, e := range entries {
+		if e.info == nil {
+			result.CommonPrefixes = append(result.CommonPrefixes, struct {
+				Prefix string `xml:"Prefix"`
+			}{encode(e.key)})
+			continue
+		}
+		result.Contents = append(result.Contents, s3Object{
+			Key:          encode(e.key),
+			LastModified: e.info.ModTime().UTC(),
+			ETag:         s3ETag(e.info),
+			Size:         e.info.Size(),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.IsTruncated = truncated && len(entries) > 0
+	if truncated && len(entries) > 0 {
+		last := entries[len(entries)-1].key
+		if v2 {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		} else {
+			result.NextMarker = encode(last)
+		}
+	}
+	if v2 {
+		count := len(entries)
+		result.KeyCount = &count
+	}
+	writeS3XML(w, http.StatusOK, result)
+	return nil
+}
+
+// s3Entry is a key of the listing, info is nil for common prefixes
+type s3Entry struct {
+	key  string
+	info os.FileInfo
+}
+
+// list returns at most maxKeys keys after marker in the order of S3. Directories are walked
+// depth first with their children sorted by key, which keeps keys of the whole tree in order.
+// With the delimiter / a directory is returned as a common prefix instead.
+func (api *S3API) list(r *http.Request, prefix, delimiter, marker string, maxKeys int) (entries []s3Entry, truncated bool) {
+	s := api.s
+	add := func(e s3Entry) bool {
+		if len(entries) == maxKeys {
+			truncated = true
+			return false
+		}
+		entries = append(entries, e)
+		return true
+	}
+	var walk func(dirKey string) bool
+	walk = func(dirKey string) bool {
+		relDir := path.Clean("/" + dirKey)
+		auth := s.dirAccess(relDir).conf
+		auth.path = relDir
+		if !auth.canList(r) {
+			return true
+		}
+		infos, err := s.fs().ReadDir(s.realPathOf(relDir))
+		if err != nil {
+			return true
+		}
+		if relDir == "/" && len(s.Mounts) > 0 {
+			byName := make(map[string]os.FileInfo)
+			for _, info := range append(infos, s.mountInfos()...) { // mount points replace files with the same name
+				byName[info.Name()] = info
+			}
+			infos = infos[:0]
+			for _, info := range byName {
+				infos = append(infos, info)
+			}
+		}
+		children := make([]s3Entry, 0, len(infos))
+		for _, info := range infos {
+			name := info.Name()
+			if name == YAMLCONF || strings.HasPrefix(name, s3TempPrefix) || !auth.visible(r, path.Join(relDir, name)) {
+				continue
+			}
+			key := dirKey + name
+			if info.IsDir() {
+				key += "/"
+			}
+			children = append(children, s3Entry{key, info})
+		}
+		sort.Slice(children, func(i, j int) bool {
+			return children[i].key < children[j].key
+		})
+
+		for _, e := range children {
+			if !e.info.IsDir() {
+				if strings.HasPrefix(e.key, prefix) && e.key > marker && !add(e) {
+					return false
+				}
+				continue
+			}
+			if !strings.HasPrefix(e.key, prefix) && !strings.HasPrefix(prefix, e.key) {
+				continue
+			}
+			if delimiter == "/" && len(e.key) > len(prefix) {
+				sub := s.dirAccess(path.Clean("/" + e.key)).conf
+				sub.path = path.Clean("/" + e.key)
+				if e.key > marker && sub.canList(r) && !add(s3Entry{key: e.key}) {
+					return false
+				}
+				continue
+			}
+			if e.key < marker && !strings.HasPrefix(marker, e.key) { // keys inside are all before marker
+				continue
+			}
+			if !walk(e.key) {
+				return false
+			}
+		}
+		return true
+	}
+	walk(prefix[:strings.LastIndex(prefix, "/")+1])
+	return
+}
+
+type s3CompleteRequest struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+// upload returns the multipart upload of key started by the same access key
+func (api *S3API) upload(r *http.Request, key, uploadID string) (*s3Upload, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	u := api.uploads[uploadID]
+	if u == nil || u.key != key || u.accessKey != requestS3Key(r).AccessKey {
+		return nil, s3Err(http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist")
+	}
+	return u, nil
+}
+
+func (api *S3API) removeUpload(uploadID string) {
+	api.mu.Lock()
+	u := api.uploads[uploadID]
+	delete(api.uploads, uploadID)
+	api.mu.Unlock()
+	if u != nil {
+		os.RemoveAll(u.dir)
+	}
+}
+
+func (api *S3API) createUpload(w http.ResponseWriter, r *http.Request, key string) error {
+	relPath, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+	if _, err := api.writeAccess(r, relPath, AuditUpload); err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "ghs-s3-upload-")
+	if err != nil {
+		return err
+	}
+	id := randomHex(16)
+	api.mu.Lock()
+	for id, u := range api.uploads { // uploads which are never completed or aborted
+		if time.Since(u.created) > s3UploadExpires {
+			delete(api.uploads, id)
+			os.RemoveAll(u.dir)
+		}
+	}
+	api.uploads[id] = &s3Upload{
+		key:       key,
+		accessKey: requestS3Key(r).AccessKey,
+		dir:       dir,
+		created:   time.Now(),
+		parts:     make(map[int]string),
+	}
+	api.mu.Unlock()
+	writeS3XML(w, http.StatusOK, &struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Xmlns: s3Namespace, Bucket: api.conf.Bucket, Key: key, UploadID: id})
+	return nil
+}
+
+func (api *S3API) uploadPart(w http.ResponseWriter, r *http.Request, key, uploadID string) error {
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 || number > 10000 {
+		return s3Err(http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive")
+	}
+	u, err := api.upload(r, key, uploadID)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(u.dir, strconv.Itoa(number)))
+	if err != nil {
+		return err
+	}
+	md5sum := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, md5sum), r.Context().Value(ctxKeyS3).(*s3Auth).payload(r))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if want := r.Header.Get("Content-MD5"); err == nil && want != "" && want != base64.StdEncoding.EncodeToString(md5sum.Sum(nil)) {
+		err = s3Err(http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received")
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	etag := hex.EncodeToString(md5sum.Sum(nil))
+	api.mu.Lock()
+	u.parts[number] = etag
+	api.mu.Unlock()
+	w.Header().Set("ETag", `"`+etag+`"`)
+	return nil
+}
+
+func (api *S3API) completeUpload(w http.ResponseWriter, r *http.Request, key, uploadID string) error {
+	relPath, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+	u, err := api.upload(r, key, uploadID)
+	if err != nil {
+		return err
+	}
+	var req s3CompleteRequest
+	if err := xml.NewDecoder(io.LimitReader(r.Context().Value(ctxKeyS3).(*s3Auth).payload(r), 2<<20)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		if e, ok := err.(*s3APIError); ok {
+			return e
+		}
+		return s3Err(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema")
+	}
+	// md5 of the part md5s like S3, so that clients can tell it from the md5 of the content
+	etagHash := md5.New()
+	api.mu.Lock()
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			api.mu.Unlock()
+			return s3Err(http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order")
+		}
+		etag, ok := u.parts[part.PartNumber]
+		if !ok || etag != strings.Trim(part.ETag, `"`) {
+			api.mu.Unlock()
+			return s3Err(http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found")
+		}
+		sum, _ := hex.DecodeString(etag)
+		etagHash.Write(sum)
+	}
+	api.mu.Unlock()
+
+	entry, err := api.writeAccess(r, relPath, AuditUpload)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		for _, part := range req.Parts {
+			f, err := os.Open(filepath.Join(u.dir, strconv.Itoa(part.PartNumber)))
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(pw, f)
+			f.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	if _, err := api.writeObject(api.s.realPathOf(relPath), pr, "", entry); err != nil {
+		return err
+	}
+	api.removeUpload(uploadID)
+	etag := fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(etagHash.Sum(nil)), len(req.Parts))
+	writeS3XML(w, http.StatusOK, &struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string   `xml:"Location"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		ETag     string   `xml:"ETag"`
+	}{Xmlns: s3Namespace, Location: "/" + api.conf.Bucket + "/" + key, Bucket: api.conf.Bucket, Key: key, ETag: etag})
+	return nil
+}
+
+func (api *S3API) abortUpload(w http.ResponseWriter, r *http.Request, key, uploadID string) error {
+	if _, err := api.upload(r, key, uploadID); err != nil {
+		return err
+	}
+	api.removeUpload(uploadID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestS3API(t *testing.T) (dir string, alice, bob *S3Storage) {
+	dir = t.TempDir()
+	for name, data := range map[string]string{
+		"a.txt":          "0123456789",
+		"docs/b.txt":     "b",
+		"docs/sub/c.md":  "c",
+		"docs-old/d.txt": "d",
+		"secret/s.txt":   "s",
+		YAMLCONF:         "upload: false\nusers:\n- email: alice@example.com\n  upload: true\n  delete: true\naccessTables:\n- regex: secret\n  action: deny\n- regex: '^s\\.txt$'\n  action: deny\n",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644))
+	}
+	api := NewS3API(&HTTPStaticServer{Root: dir}, S3APIConf{Keys: []S3Key{
+		{AccessKey: "alice", SecretKey: "alice-secret", Email: "alice@example.com"},
+		{AccessKey: "bob", SecretKey: "bob-secret", Email: "bob@example.com"},
+	}})
+	api.s.bufPool.New = func() interface{} { return make([]byte, 32*1024) }
+	ts := httptest.NewServer(api.Handler(nil))
+	t.Cleanup(ts.Close)
+	var err error
+	alice, err = NewS3Storage(StorageConf{Endpoint: ts.URL, Bucket: "ghs", AccessKey: "alice", SecretKey: "alice-secret"})
+	assert.Nil(t, err)
+	bob, err = NewS3Storage(StorageConf{Endpoint: ts.URL, Bucket: "ghs", AccessKey: "bob", SecretKey: "bob-secret"})
+	assert.Nil(t, err)
+	return
+}
+
+func TestS3APIObjects(t *testing.T) {
+	dir, alice, bob := newTestS3API(t)
+
+	infos, err := bob.ReadDir("/")
+	assert.Nil(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, fmt.Sprintf("%s:%v", info.Name(), info.IsDir()))
+	}
+	assert.Equal(t, []string{"a.txt:false", "docs:true", "docs-old:true"}, names)
+
+	var keys []string
+	var page *s3ListResult
+	err = bob.c.list("", "", 2, func(p *s3ListResult) error {
+		page = p
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, page.IsTruncated)
+	query := url.Values{"list-type": {"2"}, "continuation-token": {page.NextContinuationToken}}
+	resp, err := bob.c.do("GET", "", query, nil, nil, 0, "")
+	assert.Nil(t, err)
+	next := new(s3ListResult)
+	xml.NewDecoder(resp.Body).Decode(next)
+	resp.Body.Close()
+	for _, obj := range append(page.Contents, next.Contents...) {
+		keys = append(keys, obj.Key)
+	}
+	assert.Equal(t, []string{"a.txt", "docs-old/d.txt", "docs/b.txt", "docs/sub/c.md"}, keys)
+	assert.False(t, next.IsTruncated)
+
+	f, err := bob.Open("/a.txt")
+	assert.Nil(t, err)
+	buf := make([]byte, 3)
+	n, _ := f.ReadAt(buf, 4)
+	assert.Equal(t, "456", string(buf[:n]))
+	f.Close()
+	_, err = bob.Stat("/secret/s.txt")
+	assert.Error(t, err)
+	_, err = bob.Stat("/secret")
+	assert.Error(t, err)
+	_, err = bob.Open("/" + YAMLCONF)
+	assert.Error(t, err)
+
+	_, err = writeS3(bob, "/new.txt", "bob")
+	assert.Error(t, err)
+	_, err = writeS3(alice, "/docs/new.txt", "alice")
+	assert.Nil(t, err)
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "docs/new.txt"))
+	assert.Equal(t, "alice", string(data))
+	err = alice.put("/docs/new.txt", "docs/new.txt", strings.NewReader(""), 0, emptySHA256, http.Header{"If-None-Match": {"*"}})
+	assert.True(t, os.IsExist(err))
+	_, err = writeS3(alice, "/"+YAMLCONF, "upload: true")
+	assert.Error(t, err)
+
+	assert.Nil(t, alice.Rename("/docs/new.txt", "/moved.txt"))
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "moved.txt"))
+	assert.Equal(t, "alice", string(data))
+	assert.False(t, fileExists(filepath.Join(dir, "docs/new.txt")))
+	assert.Nil(t, alice.MkdirAll("/made"))
+	assert.True(t, isDir(filepath.Join(dir, "made")))
+
+	assert.Error(t, bob.RemoveAll("/a.txt"))
+	assert.True(t, fileExists(filepath.Join(dir, "a.txt")))
+	assert.Nil(t, alice.RemoveAll("/a.txt"))
+	assert.False(t, fileExists(filepath.Join(dir, "a.txt")))
+}
+
+func writeS3(fs *S3Storage, name, data string) (int, error) {
+	w, err := fs.Create(name, false)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := io.WriteString(w, data)
+	return n, w.Close()
+}
+
+func TestS3APIMultipart(t *testing.T) {
+	dir, alice, _ := newTestS3API(t)
+	c := alice.c
+	resp, err := c.do("POST", "big.bin", url.Values{"uploads": {""}}, nil, nil, 0, "")
+	assert.Nil(t, err)
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	xml.NewDecoder(resp.Body).Decode(&initiate)
+	resp.Body.Close()
+	assert.NotEmpty(t, initiate.UploadID)
+
+	var complete bytes.Buffer
+	complete.WriteString("<CompleteMultipartUpload>")
+	for i, part := range []string{"hello ", "world"} {
+		sum := sha256.Sum256([]byte(part))
+		query := url.Values{"partNumber": {fmt.Sprint(i + 1)}, "uploadId": {initiate.UploadID}}
+		resp, err := c.do("PUT", "big.bin", query, nil, strings.NewReader(part), int64(len(part)), hex.EncodeToString(sum[:]))
+		assert.Nil(t, err)
+		resp.Body.Close()
+		fmt.Fprintf(&complete, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, resp.Header.Get("ETag"))
+	}
+	complete.WriteString("</CompleteMultipartUpload>")
+	sum := sha256.Sum256(complete.Bytes())
+	resp, err = c.do("POST", "big.bin", url.Values{"uploadId": {initiate.UploadID}}, nil,
+		bytes.NewReader(complete.Bytes()), int64(complete.Len()), hex.EncodeToString(sum[:]))
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(t, string(body), "-2&#34;</ETag>")
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "big.bin"))
+	assert.Equal(t, "hello world", string(data))
+
+	_, err = c.do("DELETE", "big.bin", url.Values{"uploadId": {initiate.UploadID}}, nil, nil, 0, "")
+	assert.Equal(t, "NoSuchUpload", err.(*s3Error).Code)
+}
+
+func TestS3APIAuth(t *testing.T) {
+	_, alice, _ := newTestS3API(t)
+	endpoint := alice.c.endpoint.String()
+
+	resp, err := http.Get(endpoint + "/ghs/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// presigned url
+	amzDate := time.Now().UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/us-east-1/s3/aws4_request"
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {"alice/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {"60"},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	u, _ := url.Parse(endpoint)
+	canonicalRequest := "GET\n/ghs/a.txt\n" + s3Query(query) + "\nhost:" + u.Host + "\n\nhost\nUNSIGNED-PAYLOAD"
+	signature := sigV4Sign(sigV4Key("alice-secret", amzDate[:8], "us-east-1"), amzDate, scope, canonicalRequest)
+	resp, err = http.Get(endpoint + "/ghs/a.txt?" + s3Query(query) + "&X-Amz-Signature=" + signature)
+	assert.Nil(t, err)
+	data, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "0123456789", string(data))
+	resp, _ = http.Get(endpoint + "/ghs/a.txt?" + s3Query(query) + "&X-Amz-Signature=" + strings.Repeat("0", 64))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	wrong, _ := NewS3Storage(StorageConf{Endpoint: endpoint, Bucket: "ghs", AccessKey: "alice", SecretKey: "wrong"})
+	_, err = wrong.Stat("/a.txt")
+	assert.Error(t, err)
+}
+
+func TestS3ChunkedReader(t *testing.T) {
+	// example of https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-streaming.html
+	a := &s3Auth{
+		amzDate:    "20130524T000000Z",
+		scope:      "20130524/us-east-1/s3/aws4_request",
+		signingKey: sigV4Key("wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", "20130524", "us-east-1"),
+		signature:  "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9",
+	}
+	body := "10000;chunk-signature=ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648\r\n" +
+		strings.Repeat("a", 65536) + "\r\n" +
+		"400;chunk-signature=0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497\r\n" +
+		strings.Repeat("a", 1024) + "\r\n" +
+		"0;chunk-signature=b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9\r\n\r\n"
+	r := httptest.NewRequest("PUT", "/examplebucket/chunkObject.txt", strings.NewReader(body))
+	a.payloadHash = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	data, err := ioutil.ReadAll(a.payload(r))
+	assert.Nil(t, err)
+	assert.Equal(t, 66560, len(data))
+
+	r = httptest.NewRequest("PUT", "/examplebucket/chunkObject.txt", strings.NewReader(strings.Replace(body, "aaaa\r\n", "aaab\r\n", 1)))
+	_, err = ioutil.ReadAll(a.payload(r))
+	assert.Error(t, err)
+}
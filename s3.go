@@ -0,0 +1,673 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type StorageConf struct {
+	Type      string `yaml:"type"`       // local or s3, default local
+	Endpoint  string `yaml:"endpoint"`   // eg: http://127.0.0.1:9000, default to https://s3.<region>.amazonaws.com
+	Region    string `yaml:"region"`     // default us-east-1
+	Bucket    string `yaml:"bucket"`     // buckets are addressed in path style: <endpoint>/<bucket>/<key>
+	Prefix    string `yaml:"prefix"`     // key prefix of the files, eg: builds/
+	AccessKey string `yaml:"access-key"` // default to $AWS_ACCESS_KEY_ID
+	SecretKey string `yaml:"secret-key"` // default to $AWS_SECRET_ACCESS_KEY
+}
+
+// newStorage returns nil for the local filesystem
+func newStorage(conf StorageConf) (Storage, error) {
+	switch conf.Type {
+	case "", "local":
+		return nil, nil
+	case "s3":
+		fs, err := NewS3Storage(conf)
+		if err != nil {
+			return nil, err
+		}
+		return fs, nil
+	}
+	return nil, fmt.Errorf("storage.type: unknown type %s, must be local or s3", strconv.Quote(conf.Type))
+}
+
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Client signs requests with AWS signature version 4
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// s3Error is the error document returned by S3
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+// s3Escape encodes s as uri-encode of the signature, / is kept when path is true
+func s3Escape(s string, path bool) string {
+	var buf strings.Builder
+	for _, b := range []byte(s) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (path && b == '/') {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds the Authorization header, host, range and x-amz-* headers are signed
+func (c *s3Client) sign(req *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	signature := sigV4Sign(sigV4Key(c.secretKey, date, c.region), amzDate, scope, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+// sigV4Key derives the signing key of date like 20130524
+func sigV4Key(secretKey, date, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, "aws4_request")
+}
+
+// sigV4Sign returns the hex signature of the canonical request
+func sigV4Sign(key []byte, amzDate, scope, canonicalRequest string) string {
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// do sends a request of the object key, or the bucket if key is empty.
+// body must be nil or seekable and payloadHash is its sha256, responses other than 2xx are returned as *s3Error
+func (c *s3Client) do(method, key string, query url.Values, header http.Header, body io.ReadSeeker, size int64, payloadHash string) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket + "/" + key
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	if payloadHash == "" {
+		payloadHash = emptySHA256
+	}
+	c.sign(req, payloadHash, time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		e := &s3Error{StatusCode: resp.StatusCode}
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		xml.Unmarshal(data, e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag,omitempty"`
+	Size         int64     `xml:"Size"`
+	StorageClass string    `xml:"StorageClass,omitempty"`
+}
+
+type s3ListResult struct {
+	IsTruncated    bool       `xml:"IsTruncated"`
+	Contents       []s3Object `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list calls fn with every page of ListObjectsV2, maxKeys 0 means all keys
+func (c *s3Client) list(prefix, delimiter string, maxKeys int, fn func(page *s3ListResult) error) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	for {
+		resp, err := c.do("GET", "", query, nil, nil, 0, "")
+		if err != nil {
+			return err
+		}
+		page := new(s3ListResult)
+		err = xml.NewDecoder(resp.Body).Decode(page)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
+		if maxKeys > 0 || !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// S3Storage keeps files in an S3 compatible bucket. Directories are the common prefixes of keys,
+// empty directories are kept as empty objects with names end with /.
+type S3Storage struct {
+	c      *s3Client
+	prefix string
+}
+
+func NewS3Storage(conf StorageConf) (*S3Storage, error) {
+	if conf.Bucket == "" {
+		return nil, fmt.Errorf("storage.bucket: required for s3")
+	}
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+	if conf.Endpoint == "" {
+		conf.Endpoint = "https://s3." + conf.Region + ".amazonaws.com"
+	}
+	if conf.AccessKey == "" {
+		conf.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if conf.SecretKey == "" {
+		conf.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("storage.endpoint: invalid url %s", strconv.Quote(conf.Endpoint))
+	}
+	prefix := strings.Trim(conf.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3Storage{
+		c: &s3Client{
+			endpoint:  endpoint,
+			region:    conf.Region,
+			bucket:    conf.Bucket,
+			accessKey: conf.AccessKey,
+			secretKey: conf.SecretKey,
+			client:    &http.Client{Timeout: 10 * time.Minute},
+		},
+		prefix: prefix,
+	}, nil
+}
+
+func (fs *S3Storage) key(name string) string {
+	return fs.prefix + strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+// dirKey is the prefix of the keys inside of the directory name
+func (fs *S3Storage) dirKey(name string) string {
+	key := fs.key(name)
+	if key == "" || strings.HasSuffix(key, "/") {
+		return key
+	}
+	return key + "/"
+}
+
+// pathError converts not found to os.ErrNotExist
+func pathError(op, name string, err error) error {
+	if e, ok := err.(*s3Error); ok && (e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey") {
+		err = os.ErrNotExist
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (fs *S3Storage) head(name string) (*fileInfo, error) {
+	resp, err := fs.c.do("HEAD", fs.key(name), nil, nil, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &fileInfo{name: path.Base(name), size: resp.ContentLength, modTime: modTime}, nil
+}
+
+func (fs *S3Storage) Stat(name string) (os.FileInfo, error) {
+	if fs.key(name) == fs.prefix {
+		return &fileInfo{name: path.Base(name), dir: true}, nil
+	}
+	info, err := fs.head(name)
+	if err == nil {
+		return info, nil
+	}
+	if e, ok := err.(*s3Error); !ok || e.StatusCode != http.StatusNotFound {
+		return nil, pathError("stat", name, err)
+	}
+	found := false
+	err = fs.c.list(fs.dirKey(name), "/", 1, func(page *s3ListResult) error {
+		found = len(page.Contents) > 0 || len(page.CommonPrefixes) > 0
+		return nil
+	})
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	if !found {
+		return nil, pathError("stat", name, os.ErrNotExist)
+	}
+	return &fileInfo{name: path.Base(name), dir: true}, nil
+}
+
+func (fs *S3Storage) ReadDir(name string) ([]os.FileInfo, error) {
+	prefix := fs.dirKey(name)
+	infos := make([]os.FileInfo, 0)
+	err := fs.c.list(prefix, "/", 0, func(page *s3ListResult) error {
+		for _, obj := range page.Contents {
+			if obj.Key == prefix { // the directory itself
+				continue
+			}
+			infos = append(infos, &fileInfo{name: strings.TrimPrefix(obj.Key, prefix), size: obj.Size, modTime: obj.LastModified})
+		}
+		for _, p := range page.CommonPrefixes {
+			infos = append(infos, &fileInfo{name: strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"), dir: true})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	if len(infos) == 0 {
+		if _, err := fs.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+	sortFileInfos(infos)
+	return infos, nil
+}
+
+// Walk lists all keys under root at once instead of every directory
+func (fs *S3Storage) Walk(root string, fn filepath.WalkFunc) error {
+	root = path.Clean("/" + filepath.ToSlash(root))
+	info, err := fs.Stat(root)
+	if err != nil || !info.IsDir() {
+		err = fn(root, info, err)
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	if err := fn(root, info, nil); err != nil {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	prefix := fs.dirKey(root)
+	visited := map[string]bool{root: true}
+	skipped := map[string]bool{}
+	// visitDir calls fn with dir and its parents which are not visited, returns false if dir is skipped
+	var visitDir func(dir string) (bool, error)
+	visitDir = func(dir string) (bool, error) {
+		if skipped[dir] {
+			return false, nil
+		}
+		if visited[dir] {
+			return true, nil
+		}
+		if ok, err := visitDir(path.Dir(dir)); !ok || err != nil {
+			skipped[dir] = !ok
+			return ok, err
+		}
+		visited[dir] = true
+		err := fn(dir, &fileInfo{name: path.Base(dir), dir: true}, nil)
+		if err == filepath.SkipDir {
+			skipped[dir] = true
+			return false, nil
+		}
+		return err == nil, err
+	}
+	return fs.c.list(prefix, "", 0, func(page *s3ListResult) error {
+		for _, obj := range page.Contents {
+			name := path.Join(root, strings.TrimPrefix(obj.Key, prefix))
+			if strings.HasSuffix(obj.Key, "/") { // empty directory
+				if _, err := visitDir(name); err != nil {
+					return err
+				}
+				continue
+			}
+			ok, err := visitDir(path.Dir(name))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			err = fn(name, &fileInfo{name: path.Base(name), size: obj.Size, modTime: obj.LastModified}, nil)
+			if err == filepath.SkipDir {
+				skipped[path.Dir(name)] = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (fs *S3Storage) Open(name string) (File, error) {
+	info, err := fs.head(name)
+	if err != nil {
+		if e, ok := err.(*s3Error); ok && e.StatusCode == http.StatusNotFound {
+			if dir, err := fs.Stat(name); err == nil {
+				return &s3File{fs: fs, name: name, info: dir.(*fileInfo)}, nil
+			}
+		}
+		return nil, pathError("open", name, err)
+	}
+	return &s3File{fs: fs, name: name, info: info}, nil
+}
+
+func (fs *S3Storage) Create(name string, exclusive bool) (io.WriteCloser, error) {
+	if exclusive {
+		if _, err := fs.Stat(name); err == nil {
+			return nil, &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+		}
+	}
+	tmp, err := ioutil.TempFile("", "ghs-upload-")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{fs: fs, name: name, exclusive: exclusive, tmp: tmp, hash: sha256.New()}, nil
+}
+
+func (fs *S3Storage) put(name, key string, body io.ReadSeeker, size int64, payloadHash string, header http.Header) error {
+	resp, err := fs.c.do("PUT", key, nil, header, body, size, payloadHash)
+	if err != nil {
+		if e, ok := err.(*s3Error); ok && e.StatusCode == http.StatusPreconditionFailed {
+			err = os.ErrExist
+		}
+		return &os.PathError{Op: "put", Path: name, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (fs *S3Storage) MkdirAll(name string) error {
+	key := fs.dirKey(name)
+	if key == fs.prefix {
+		return nil
+	}
+	return fs.put(name, key, bytes.NewReader(nil), 0, emptySHA256, nil)
+}
+
+func (fs *S3Storage) delete(name, key string) error {
+	resp, err := fs.c.do("DELETE", key, nil, nil, nil, 0, "")
+	if err != nil {
+		return pathError("delete", name, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// keys returns the key of file name, or the keys inside of directory name
+func (fs *S3Storage) keys(name string) ([]string, error) {
+	var keys []string
+	if _, err := fs.head(name); err == nil {
+		keys = append(keys, fs.key(name))
+	}
+	err := fs.c.list(fs.dirKey(name), "", 0, func(page *s3ListResult) error {
+		for _, obj := range page.Contents {
+			keys = append(keys, obj.Key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (fs *S3Storage) RemoveAll(name string) error {
+	keys, err := fs.keys(name)
+	if err != nil {
+		return pathError("remove", name, err)
+	}
+	for _, key := range keys {
+		if err := fs.delete(name, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename copies the objects to the new keys and deletes the old ones
+func (fs *S3Storage) Rename(oldname, newname string) error {
+	keys, err := fs.keys(oldname)
+	if err != nil {
+		return pathError("rename", oldname, err)
+	}
+	if len(keys) == 0 {
+		return pathError("rename", oldname, os.ErrNotExist)
+	}
+	oldKey, newKey := fs.key(oldname), fs.key(newname)
+	for _, key := range keys {
+		header := http.Header{"X-Amz-Copy-Source": {s3Escape("/"+fs.c.bucket+"/"+key, true)}}
+		if err := fs.put(newname, newKey+strings.TrimPrefix(key, oldKey), nil, 0, emptySHA256, header); err != nil {
+			return err
+		}
+		if err := fs.delete(oldname, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3File reads the object with Range requests, sequential reads share one response
+type s3File struct {
+	fs   *S3Storage
+	name string
+	info *fileInfo
+	pos  int64
+	body io.ReadCloser
+}
+
+func (f *s3File) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *s3File) get(off, end int64) (io.ReadCloser, error) {
+	rng := fmt.Sprintf("bytes=%d-", off)
+	if end >= 0 {
+		rng += strconv.FormatInt(end, 10)
+	}
+	resp, err := f.fs.c.do("GET", f.fs.key(f.name), nil, http.Header{"Range": {rng}}, nil, 0, "")
+	if err != nil {
+		return nil, pathError("read", f.name, err)
+	}
+	return resp.Body, nil
+}
+
+func (f *s3File) Read(p []byte) (n int, err error) {
+	if f.info.dir {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: fmt.Errorf("is a directory")}
+	}
+	if f.pos >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		if f.body, err = f.get(f.pos, -1); err != nil {
+			return 0, err
+		}
+	}
+	n, err = f.body.Read(p)
+	f.pos += int64(n)
+	if err == io.EOF && f.pos < f.info.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > f.info.size {
+		end = f.info.size
+	}
+	if end == off {
+		return 0, nil
+	}
+	body, err := f.get(off, end-1)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err = io.ReadFull(body, p[:end-off])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += f.pos
+	case io.SeekEnd:
+		pos += f.info.size
+	}
+	if pos < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	if pos != f.pos && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	return nil
+}
+
+// s3Writer keeps the content in a temporary file and puts the object on Close
+type s3Writer struct {
+	fs        *S3Storage
+	name      string
+	exclusive bool
+	tmp       *os.File
+	hash      hash.Hash
+	size      int64
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	n, err := w.tmp.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *s3Writer) Close() error {
+	defer os.Remove(w.tmp.Name())
+	defer w.tmp.Close()
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var header http.Header
+	if w.exclusive {
+		header = http.Header{"If-None-Match": {"*"}}
+	}
+	return w.fs.put(w.name, w.fs.key(w.name), w.tmp, w.size, hex.EncodeToString(w.hash.Sum(nil)), header)
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPConf serves root over SFTP on a separate listener
+type SFTPConf struct {
+	Addr    string     `yaml:"addr"`     // eg: :2022, disabled if empty
+	HostKey string     `yaml:"host-key"` // private key file, a new key is generated at every start if empty
+	Users   []SFTPUser `yaml:"users"`
+}
+
+// SFTPUser logs in with the password or one of the authorized keys, .ghs.yml rules of Email apply to it
+type SFTPUser struct {
+	User           string   `yaml:"user"`
+	Password       string   `yaml:"password"`
+	AuthorizedKeys []string `yaml:"authorized-keys"` // lines of authorized_keys
+	Email          string   `yaml:"email"`
+	Groups         []string `yaml:"groups"`
+}
+
+func (u *SFTPUser) user() *UserInfo {
+	return &UserInfo{
+		Id:     "sftp:" + u.User,
+		Email:  u.Email,
+		Name:   u.User,
+		Groups: u.Groups,
+	}
+}
+
+// requestSFTPUser returns the user of the SFTP session which made the request
+func requestSFTPUser(r *http.Request) *SFTPUser {
+	u, _ := r.Context().Value(ctxKeySFTP).(*SFTPUser)
+	return u
+}
+
+// parseAuthorizedKeys parses the authorized keys of every user
+func parseAuthorizedKeys(users []SFTPUser) (map[string][]ssh.PublicKey, error) {
+	keys := make(map[string][]ssh.PublicKey)
+	for i, u := range users {
+		for j, line := range u.AuthorizedKeys {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				return nil, fmt.Errorf("sftp.users[%d].authorized-keys[%d]: %v", i, j, err)
+			}
+			keys[u.User] = append(keys[u.User], key)
+		}
+	}
+	return keys, nil
+}
+
+// SFTPServer serves the files of HTTPStaticServer with the same .ghs.yml permissions
+type SFTPServer struct {
+	s      *HTTPStaticServer
+	conf   SFTPConf
+	config *ssh.ServerConfig
+}
+
+func NewSFTPServer(s *HTTPStaticServer, conf SFTPConf) (*SFTPServer, error) {
+	authorizedKeys, err := parseAuthorizedKeys(conf.Users)
+	if err != nil {
+		return nil, err
+	}
+	srv := &SFTPServer{s: s, conf: conf}
+	srv.config = &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if u := srv.user(c.User()); u != nil && u.Password != "" &&
+				subtle.ConstantTimeCompare([]byte(u.Password), password) == 1 {
+				return &ssh.Permissions{Extensions: map[string]string{"user": u.User}}, nil
+			}
+			return nil, errors.New("wrong user or password")
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, k := range authorizedKeys[c.User()] {
+				if subtle.ConstantTimeCompare(k.Marshal(), key.Marshal()) == 1 {
+					return &ssh.Permissions{Extensions: map[string]string{"user": c.User()}}, nil
+				}
+			}
+			return nil, errors.New("unknown public key")
+		},
+	}
+	signer, err := loadHostKey(conf.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	srv.config.AddHostKey(signer)
+	log.Printf("sftp: host key %s", ssh.FingerprintSHA256(signer.PublicKey()))
+	return srv, nil
+}
+
+// loadHostKey reads the private key file, an ed25519 key is generated if filename is empty
+func loadHostKey(filename string) (ssh.Signer, error) {
+	if filename == "" {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return ssh.NewSignerFromKey(key)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("sftp.host-key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("sftp.host-key: %v", err)
+	}
+	return signer, nil
+}
+
+func (srv *SFTPServer) user(name string) *SFTPUser {
+	for i := range srv.conf.Users {
+		if srv.conf.Users[i].User == name {
+			return &srv.conf.Users[i]
+		}
+	}
+	return nil
+}
+
+func (srv *SFTPServer) ListenAndServe() error {
+	ln, err := net.Listen("tcp", srv.conf.Addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ln)
+}
+
+func (srv *SFTPServer) Serve(ln net.Listener) error {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.serveConn(conn)
+	}
+}
+
+func (srv *SFTPServer) serveConn(nc net.Conn) {
+	defer nc.Close()
+	conn, chans, reqs, err := ssh.NewServerConn(nc, srv.config)
+	if err != nil {
+		log.Printf("sftp: %s: %v", nc.RemoteAddr(), err)
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+	user := srv.user(conn.Permissions.Extensions["user"])
+	log.Printf("sftp: %s logged in from %s", user.User, conn.RemoteAddr())
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channel is supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Println("sftp: accept channel:", err)
+			return
+		}
+		go func() {
+			for req := range requests {
+				// payload of the subsystem request is the length prefixed name
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				h := &sftpHandler{s: srv.s, user: user, remoteAddr: conn.RemoteAddr().String()}
+				server := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+				if err := server.Serve(); err != nil && err != io.EOF {
+					log.Printf("sftp: %s: %v", user.User, err)
+				}
+				server.Close()
+				return
+			}
+		}()
+	}
+}
+
+// sftpHandler handles the requests of a session, permissions are checked by .ghs.yml like http requests
+type sftpHandler struct {
+	s          *HTTPStaticServer
+	user       *SFTPUser
+	remoteAddr string
+}
+
+// request returns the http request which stands for the SFTP request in permission checks and the audit log
+func (h *sftpHandler) request(req *sftp.Request) *http.Request {
+	r := &http.Request{
+		Method:     req.Method,
+		URL:        &url.URL{Path: req.Filepath},
+		Header:     make(http.Header),
+		RemoteAddr: h.remoteAddr,
+		Form:       make(url.Values),
+	}
+	return r.WithContext(context.WithValue(req.Context(), ctxKeySFTP, h.user))
+}
+
+// denied logs the audit entry and returns the error for the client, not found if the path is hidden by denyStatus
+func (h *sftpHandler) denied(entry *AuditEntry, auth *AccessConf) error {
+	entry.Allowed = false
+	h.s.Audit.Log(entry)
+	if auth.DenyStatus == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	return sftp.ErrSSHFxPermissionDenied
+}
+
+// writeEntry checks whether relPath can be created or replaced, the entry is logged when it is denied
+func (h *sftpHandler) writeEntry(r *http.Request, relPath, op string) (*AuditEntry, error) {
+	s := h.s
+	auth := s.readAccessConf(s.realPathOf(path.Dir(relPath)))
+	entry := newAuditEntry(r, &auth, op, true)
+	entry.Path = relPath
+	if path.Base(relPath) == YAMLCONF || checkFilename(path.Base(relPath)) != nil || relPath == "/" ||
+		s.isMountPoint(relPath) || !auth.canUpload(r) || !auth.writable(r, relPath) {
+		return entry, h.denied(entry, &auth)
+	}
+	return entry, nil
+}
+
+// deleteEntry checks whether relPath can be removed, the entry is logged when it is denied
+func (h *sftpHandler) deleteEntry(r *http.Request, relPath string) (*AuditEntry, error) {
+	s := h.s
+	auth := s.readAccessConf(s.realPathOf(relPath))
+	entry := newAuditEntry(r, &auth, AuditDelete, true)
+	if path.Base(relPath) == YAMLCONF || relPath == "/" || s.isMountPoint(relPath) || !auth.canDelete(r) {
+		return entry, h.denied(entry, &auth)
+	}
+	return entry, nil
+}
+
+func (h *sftpHandler) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	s := h.s
+	r := h.request(req)
+	realPath := s.realPathOf(req.Filepath)
+	auth := s.readAccessConf(realPath)
+	if path.Base(req.Filepath) == YAMLCONF {
+		return nil, os.ErrNotExist
+	}
+	if !auth.canRead(r) {
+		return nil, h.denied(newAuditEntry(r, &auth, AuditRead, false), &auth)
+	}
+	f, err := s.fs().Open(realPath)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		f.Close()
+		return nil, sftp.ErrSSHFxFailure
+	}
+	return f, nil
+}
+
+func (h *sftpHandler) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	s := h.s
+	r := h.request(req)
+	flags := req.Pflags()
+	entry, err := h.writeEntry(r, req.Filepath, AuditUpload)
+	if err != nil {
+		return nil, err
+	}
+	realPath := s.realPathOf(req.Filepath)
+	if s.isDir(realPath) {
+		return nil, sftp.ErrSSHFxFailure
+	}
+	if s.Storage == nil { // local files are written in place
+		if err := s.confine("open", realPath); err != nil {
+			return nil, err
+		}
+		flag := os.O_WRONLY | os.O_CREATE
+		if flags.Trunc {
+			flag |= os.O_TRUNC
+		}
+		if flags.Excl {
+			flag |= os.O_EXCL
+		}
+		f, err := os.OpenFile(realPath, flag, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &sftpWriter{File: f, h: h, entry: entry}, nil
+	}
+	if !flags.Trunc && s.isFile(realPath) {
+		return nil, sftp.ErrSSHFxOpUnsupported // resuming is only supported by local files
+	}
+	if flags.Excl && s.isFile(realPath) {
+		return nil, os.ErrExist
+	}
+	f, err := ioutil.TempFile("", "ghs-sftp-")
+	if err != nil {
+		return nil, err
+	}
+	return &sftpWriter{File: f, h: h, entry: entry, name: realPath, exclusive: flags.Excl}, nil
+}
+
+// sftpWriter is an opened upload, which is logged to audit log on Close. Uploads to other storages
+// than local files are written to a temporary file first, because they can not be written at random offsets.
+type sftpWriter struct {
+	*os.File
+	h         *sftpHandler
+	entry     *AuditEntry
+	name      string // real path in the storage, empty if File is the real file
+	exclusive bool
+}
+
+func (w *sftpWriter) Close() error {
+	err := w.store()
+	w.File.Close()
+	if w.name != "" {
+		os.Remove(w.File.Name())
+	}
+	if err != nil {
+		w.entry.Error = err.Error()
+	}
+	w.h.s.Audit.Log(w.entry)
+	return err
+}
+
+func (w *sftpWriter) store() error {
+	if w.name == "" {
+		info, err := w.File.Stat()
+		if err == nil {
+			w.entry.Size = info.Size()
+		}
+		return err
+	}
+	if _, err := w.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dst, err := w.h.s.fs().Create(w.name, w.exclusive)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	w.entry.Size, err = io.Copy(io.MultiWriter(dst, hash), w.File)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	w.entry.Digest = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	return err
+}
+
+func (h *sftpHandler) Filecmd(req *sftp.Request) error {
+	s := h.s
+	r := h.request(req)
+	switch req.Method {
+	case "Setstat":
+		return nil // modes and times are not kept
+	case "Mkdir":
+		entry, err := h.writeEntry(r, req.Filepath, AuditMkdir)
+		if err != nil {
+			return err
+		}
+		realPath := s.realPathOf(req.Filepath)
+		if _, err := s.fs().Stat(realPath); err == nil {
+			return os.ErrExist
+		}
+		if !s.isDir(s.realPathOf(path.Dir(req.Filepath))) {
+			return os.ErrNotExist
+		}
+		if err = s.fs().MkdirAll(realPath); err != nil {
+			entry.Error = err.Error()
+		}
+		s.Audit.Log(entry)
+		return err
+	case "Remove", "Rmdir":
+		entry, err := h.deleteEntry(r, req.Filepath)
+		if err != nil {
+			return err
+		}
+		realPath := s.realPathOf(req.Filepath)
+		info, err := s.fs().Stat(realPath)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() != (req.Method == "Rmdir") {
+			return sftp.ErrSSHFxFailure
+		}
+		if info.IsDir() {
+			if infos, err := s.fs().ReadDir(realPath); err != nil || len(infos) > 0 {
+				return sftp.ErrSSHFxFailure // not empty
+			}
+		}
+		if err = s.fs().RemoveAll(realPath); err != nil {
+			entry.Error = err.Error()
+		} else if err := s.Stats.Remove(req.Filepath); err != nil {
+			log.Println("Remove download stats:", err)
+		}
+		s.Audit.Log(entry)
+		return err
+	case "Rename":
+		return h.rename(r, req.Filepath, req.Target, false)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// PosixRename replaces the target if it exists
+func (h *sftpHandler) PosixRename(req *sftp.Request) error {
+	return h.rename(h.request(req), req.Filepath, req.Target, true)
+}
+
+// rename is a delete of oldpath and an upload of newpath for the permissions and the audit log
+func (h *sftpHandler) rename(r *http.Request, oldpath, newpath string, replace bool) error {
+	s := h.s
+	deleted, err := h.deleteEntry(r, oldpath)
+	if err != nil {
+		return err
+	}
+	uploaded, err := h.writeEntry(r, newpath, AuditUpload)
+	if err != nil {
+		return err
+	}
+	if _, err := s.fs().Stat(s.realPathOf(newpath)); err == nil && !replace {
+		return os.ErrExist
+	}
+	err = s.fs().Rename(s.realPathOf(oldpath), s.realPathOf(newpath))
+	if err != nil {
+		deleted.Error, uploaded.Error = err.Error(), err.Error()
+	}
+	s.Audit.Log(deleted)
+	s.Audit.Log(uploaded)
+	return err
+}
+
+func (h *sftpHandler) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	s := h.s
+	r := h.request(req)
+	relPath := req.Filepath
+	realPath := s.realPathOf(relPath)
+	switch req.Method {
+	case "List":
+		auth := s.readAccessConf(realPath)
+		if !auth.canList(r) {
+			return nil, h.denied(newAuditEntry(r, &auth, AuditList, false), &auth)
+		}
+		infos, err := s.fs().ReadDir(realPath)
+		if err != nil {
+			return nil, err
+		}
+		if relPath == "/" && len(s.Mounts) > 0 {
+			byName := make(map[string]int)
+			for _, info := range s.mountInfos() { // mount points replace files with the same name
+				if i, ok := byName[info.Name()]; ok {
+					infos[i] = info
+					continue
+				}
+				byName[info.Name()] = len(infos)
+				infos = append(infos, info)
+			}
+		}
+		list := make(sftpLister, 0, len(infos))
+		for _, info := range infos {
+			childPath := path.Join(relPath, info.Name())
+			if info.Name() == YAMLCONF || !auth.visible(r, childPath) {
+				continue
+			}
+			if info.IsDir() {
+				if dirAuth := s.readAccessConf(s.realPathOf(childPath)); !dirAuth.canList(r) {
+					continue
+				}
+			}
+			list = append(list, info)
+		}
+		return list, nil
+	case "Stat":
+		if relPath != "/" {
+			parent := s.readAccessConf(s.realPathOf(path.Dir(relPath)))
+			if path.Base(relPath) == YAMLCONF || !parent.visible(r, relPath) {
+				return nil, os.ErrNotExist
+			}
+		}
+		info, err := s.fs().Stat(realPath)
+		if err != nil {
+			return nil, err
+		}
+		return sftpLister{mountInfo{FileInfo: info, name: path.Base(relPath)}}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// sftpLister returns the file infos of a listing page by page
+type sftpLister []os.FileInfo
+
+func (l sftpLister) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
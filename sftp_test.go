@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func dialSFTP(t *testing.T, addr string, user string, auth ssh.AuthMethod) (*sftp.Client, error) {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	return sftp.NewClient(conn)
+}
+
+func TestSFTPServer(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"a.txt":        "0123456789",
+		"docs/b.txt":   "b",
+		"secret/s.txt": "s",
+		YAMLCONF:       "upload: false\nusers:\n- email: alice@example.com\n  upload: true\n  delete: true\naccessTables:\n- regex: secret\n  action: deny\n- regex: '^s\\.txt$'\n  action: deny\n",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644))
+	}
+	_, bobKey, _ := ed25519.GenerateKey(rand.Reader)
+	bobSigner, _ := ssh.NewSignerFromKey(bobKey)
+	srv, err := NewSFTPServer(&HTTPStaticServer{Root: dir}, SFTPConf{Users: []SFTPUser{
+		{User: "alice", Password: "alice-pass", Email: "alice@example.com"},
+		{User: "bob", AuthorizedKeys: []string{string(ssh.MarshalAuthorizedKey(bobSigner.PublicKey()))}, Email: "bob@example.com"},
+	}})
+	assert.Nil(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go srv.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	addr := ln.Addr().String()
+
+	_, err = dialSFTP(t, addr, "alice", ssh.Password("wrong"))
+	assert.Error(t, err)
+	alice, err := dialSFTP(t, addr, "alice", ssh.Password("alice-pass"))
+	assert.Nil(t, err)
+	bob, err := dialSFTP(t, addr, "bob", ssh.PublicKeys(bobSigner))
+	assert.Nil(t, err)
+
+	infos, err := bob.ReadDir("/")
+	assert.Nil(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"a.txt", "docs"}, names)
+	info, err := bob.Stat("/docs")
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+	_, err = bob.Stat("/" + YAMLCONF)
+	assert.True(t, os.IsNotExist(err))
+
+	f, err := bob.Open("/a.txt")
+	assert.Nil(t, err)
+	f.Seek(4, io.SeekStart)
+	data, _ := ioutil.ReadAll(f)
+	assert.Equal(t, "456789", string(data))
+	f.Close()
+	_, err = bob.Open("/secret/s.txt")
+	assert.Error(t, err)
+
+	_, err = bob.Create("/bob.txt")
+	assert.Error(t, err)
+	assert.Error(t, bob.Remove("/a.txt"))
+
+	f, err = alice.Create("/docs/new.txt")
+	assert.Nil(t, err)
+	io.WriteString(f, "hello")
+	assert.Nil(t, f.Close())
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "docs/new.txt"))
+	assert.Equal(t, "hello", string(data))
+	_, err = alice.Create("/" + YAMLCONF)
+	assert.Error(t, err)
+
+	assert.Nil(t, alice.Mkdir("/made"))
+	assert.Nil(t, alice.Rename("/docs/new.txt", "/made/new.txt"))
+	assert.True(t, fileExists(filepath.Join(dir, "made/new.txt")))
+	assert.Error(t, alice.RemoveDirectory("/made"))
+	assert.Nil(t, alice.Remove("/made/new.txt"))
+	assert.Nil(t, alice.RemoveDirectory("/made"))
+	assert.False(t, isDir(filepath.Join(dir, "made")))
+}
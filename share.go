@@ -0,0 +1,515 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Modes of share links
+const (
+	ShareRead   = "read"   // download the file or files under the folder
+	ShareUpload = "upload" // upload only, a drop box folder
+)
+
+type ShareLink struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"` // relative to root, eg: /foo/bar.txt
+	Mode         string    `json:"mode"`
+	Salt         string    `json:"salt,omitempty"`
+	PasswordHash string    `json:"passwordHash,omitempty"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"` // 0 means no limit
+	Downloads    int       `json:"downloads"`
+	Creator      string    `json:"creator,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	Token        string    `json:"token,omitempty"`
+}
+
+func (l *ShareLink) expired() bool {
+	return time.Now().After(l.ExpiresAt)
+}
+
+func (l *ShareLink) HasPassword() bool {
+	return l.PasswordHash != ""
+}
+
+func hashPassword(salt, password string) string {
+	sum := sha256.Sum256([]byte(salt + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// ShareStore keeps share links, links are saved into a json file when path is not empty
+type ShareStore struct {
+	path   string
+	mu     sync.Mutex
+	Secret string       `json:"secret"`
+	Links  []*ShareLink `json:"links"`
+}
+
+func OpenShareStore(filename string) (*ShareStore, error) {
+	ss := &ShareStore{path: filename}
+	if filename != "" {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, ss); err != nil {
+				return nil, fmt.Errorf("share file %s: %v", filename, err)
+			}
+		}
+	}
+	if ss.Secret == "" {
+		ss.Secret = randomHex(32)
+	}
+	return ss, nil
+}
+
+func (ss *ShareStore) save() error {
+	if ss.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(ss, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := ss.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, ss.path)
+}
+
+func (ss *ShareStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, []byte(ss.Secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:18])
+}
+
+// Create a link, token of the link is <id>.<expires>.<signature>
+func (ss *ShareStore) Create(link *ShareLink, password string) error {
+	if link.Mode != ShareRead && link.Mode != ShareUpload {
+		return fmt.Errorf("invalid mode %s, must be read or upload", strconv.Quote(link.Mode))
+	}
+	link.ID = randomHex(6)
+	link.CreatedAt = time.Now()
+	if password != "" {
+		link.Salt = randomHex(8)
+		link.PasswordHash = hashPassword(link.Salt, password)
+	}
+	payload := link.ID + "." + strconv.FormatInt(link.ExpiresAt.Unix(), 36)
+	link.Token = payload + "." + ss.sign(payload)
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.Links = append(ss.Links, link)
+	ss.removeExpired()
+	return ss.save()
+}
+
+func (ss *ShareStore) removeExpired() {
+	links := ss.Links[:0]
+	for _, l := range ss.Links {
+		if !l.expired() {
+			links = append(links, l)
+		}
+	}
+	ss.Links = links
+}
+
+// Get verifies the signature of token and returns a copy of the link
+func (ss *ShareStore) Get(token string) (ShareLink, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(ss.sign(parts[0]+"."+parts[1])), []byte(parts[2])) {
+		return ShareLink{}, errors.New("invalid share link")
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, l := range ss.Links {
+		if l.ID != parts[0] {
+			continue
+		}
+		if l.expired() {
+			break
+		}
+		return *l, nil
+	}
+	return ShareLink{}, errors.New("share link expired or revoked")
+}
+
+// countDownload returns error if reaches max downloads
+func (ss *ShareStore) countDownload(id string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, l := range ss.Links {
+		if l.ID == id {
+			if l.MaxDownloads > 0 && l.Downloads >= l.MaxDownloads {
+				return errors.New("download limit reached")
+			}
+			l.Downloads++
+			return ss.save()
+		}
+	}
+	return errors.New("share link expired or revoked")
+}
+
+// owned reports whether creator can list and revoke the link, all links for admin.
+// Anonymous creators can not, they all have the same empty name.
+func (l *ShareLink) owned(creator string, admin bool) bool {
+	return admin || (creator != "" && l.Creator == creator)
+}
+
+// List returns links created by creator, all links for admin. Token, the secret of the
+// url, is only returned to the creator of the link.
+func (ss *ShareStore) List(creator string, admin bool) []ShareLink {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	links := make([]ShareLink, 0)
+	for _, l := range ss.Links {
+		if !l.expired() && l.owned(creator, admin) {
+			link := *l
+			link.Salt, link.PasswordHash = "", ""
+			if l.HasPassword() {
+				link.PasswordHash = "***"
+			}
+			if creator == "" || l.Creator != creator {
+				link.Token = ""
+			}
+			links = append(links, link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].CreatedAt.After(links[j].CreatedAt)
+	})
+	return links
+}
+
+func (ss *ShareStore) Revoke(id, creator string, admin bool) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for i, l := range ss.Links {
+		if l.ID == id && l.owned(creator, admin) {
+			ss.Links = append(ss.Links[:i], ss.Links[i+1:]...)
+			return ss.save()
+		}
+	}
+	return fmt.Errorf("share link %s not found", strconv.Quote(id))
+}
+
+// shareCreator returns the creator name used to list and revoke links, empty if anonymous
+func shareCreator(r *http.Request) string {
+	if user := currentUser(r); user != nil {
+		return user.Email
+	}
+	if gcfg.Auth.Type == "http" {
+		if username, _, ok := r.BasicAuth(); ok {
+			return "http:" + username
+		}
+	}
+	return ""
+}
+
+// hShare create share link by POST, list share links by GET
+func (s *HTTPStaticServer) hShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		creator, admin := shareCreator(r), isAdmin(r)
+		if creator == "" && !admin {
+			http.Error(w, "Login required to list share links", http.StatusForbidden)
+			return
+		}
+		links := s.Shares.List(creator, admin)
+		if r.FormValue("json") == "true" {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(links)
+			return
+		}
+		renderHTML(w, "assets/shares.html", map[string]interface{}{
+			"Title":  s.title(),
+			"Prefix": s.Prefix,
+			"Links":  links,
+		})
+		return
+	}
+
+	relPath := path.Clean("/" + r.FormValue("path"))
+	realPath := s.realPathOf(relPath)
+	info, err := s.fs().Stat(realPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	link := &ShareLink{
+		Path:    relPath,
+		Mode:    r.FormValue("mode"),
+		Creator: shareCreator(r),
+	}
+	if link.Mode == "" {
+		link.Mode = ShareRead
+	}
+
+	auth := s.readAccessConf(realPath)
+	switch link.Mode {
+	case ShareRead:
+		if !auth.canRead(r) {
+			s.deny(w, r, &auth, AuditRead)
+			return
+		}
+	case ShareUpload:
+		if !info.IsDir() {
+			http.Error(w, "Upload share link must be a directory", http.StatusBadRequest)
+			return
+		}
+		if !auth.canUpload(r) {
+			http.Error(w, "Upload forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	expires := r.FormValue("expires")
+	if expires == "" {
+		expires = "7d"
+	}
+	ttl, err := parseExpires(expires)
+	if err != nil || ttl <= 0 {
+		http.Error(w, "Invalid expires "+strconv.Quote(expires), http.StatusBadRequest)
+		return
+	}
+	link.ExpiresAt = time.Now().Add(ttl)
+	if v := r.FormValue("max-downloads"); v != "" {
+		if link.MaxDownloads, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid max-downloads", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := s.Shares.Create(link, r.FormValue("password")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.URL.Scheme == "https" {
+		scheme = "https"
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":        link.ID,
+		"url":       fmt.Sprintf("%s://%s%s/-/s/%s", scheme, r.Host, s.Prefix, link.Token),
+		"expiresAt": link.ExpiresAt,
+	})
+}
+
+func (s *HTTPStaticServer) hShareRevoke(w http.ResponseWriter, r *http.Request) {
+	creator, admin := shareCreator(r), isAdmin(r)
+	if creator == "" && !admin {
+		http.Error(w, "Login required to revoke share links", http.StatusForbidden)
+		return
+	}
+	if err := s.Shares.Revoke(mux.Vars(r)["id"], creator, admin); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Write([]byte("Success"))
+}
+
+func (s *HTTPStaticServer) sharePasswordCookie(link ShareLink) *http.Cookie {
+	return &http.Cookie{
+		Name:     "ghs-share-" + link.ID,
+		Value:    s.Shares.sign("password:" + link.ID + ":" + link.PasswordHash),
+		Path:     s.Prefix + "/-/s/",
+		Expires:  link.ExpiresAt,
+		HttpOnly: true,
+	}
+}
+
+// hShareAccess serves share links, it does not require login
+func (s *HTTPStaticServer) hShareAccess(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	link, err := s.Shares.Get(vars["token"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	data := map[string]interface{}{
+		"Title":  s.title(),
+		"Prefix": s.Prefix,
+		"Link":   link,
+		"Name":   path.Base(link.Path),
+		"Base":   s.Prefix + "/-/s/" + link.Token,
+	}
+
+	if link.HasPassword() {
+		cookie := s.sharePasswordCookie(link)
+		if c, err := r.Cookie(cookie.Name); err != nil || !hmac.Equal([]byte(c.Value), []byte(cookie.Value)) {
+			password := r.PostFormValue("password")
+			if password == "" || !hmac.Equal([]byte(hashPassword(link.Salt, password)), []byte(link.PasswordHash)) {
+				if password != "" {
+					data["Error"] = "Wrong password"
+				}
+				data["NeedPassword"] = true
+				renderHTML(w, "assets/share.html", data)
+				return
+			}
+			http.SetCookie(w, cookie)
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+			return
+		}
+	}
+
+	// make sure path not outside of the shared path
+	subPath := path.Clean("/" + vars["path"])
+	relPath := path.Join(link.Path, subPath)
+	realPath := s.realPathOf(relPath)
+	if path.Base(relPath) == YAMLCONF {
+		http.Error(w, "Security warning, not allowed to read", http.StatusForbidden)
+		return
+	}
+
+	if link.Mode == ShareUpload {
+		if r.Method == "POST" {
+			s.shareUpload(w, r, link, realPath)
+			return
+		}
+		renderHTML(w, "assets/share.html", data)
+		return
+	}
+
+	info, err := s.fs().Stat(realPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	// files inside a shared folder are still limited by .ghs.yml
+	auth := s.readAccessConf(realPath)
+	if (subPath != "/" && !auth.Read) || !auth.readable(r, relPath) {
+		entry := newAuditEntry(r, &auth, AuditRead, false)
+		entry.AuthMethod, entry.TokenID = "share", link.ID
+		s.Audit.Log(entry)
+		auth.forbidden(w, r, "Read forbidden")
+		return
+	}
+	if info.IsDir() {
+		infos, err := s.fs().ReadDir(realPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		files := make([]HTTPFileInfo, 0, len(infos))
+		for _, info := range infos {
+			if info.Name() == YAMLCONF || !auth.visible(r, path.Join(relPath, info.Name())) {
+				continue
+			}
+			if info.IsDir() {
+				if dirAuth := s.readAccessConf(filepath.Join(realPath, info.Name())); !dirAuth.Read || !dirAuth.List {
+					continue
+				}
+			}
+			fi := HTTPFileInfo{
+				Name:    info.Name(),
+				Path:    strings.TrimPrefix(path.Join(subPath, info.Name()), "/"),
+				Type:    "file",
+				Size:    info.Size(),
+				ModTime: info.ModTime().UnixNano() / 1e6,
+			}
+			if info.IsDir() {
+				fi.Type = "dir"
+			}
+			files = append(files, fi)
+		}
+		if subPath != "/" {
+			data["Name"] = path.Join(data["Name"].(string), subPath)
+		}
+		data["Files"] = files
+		renderHTML(w, "assets/share.html", data)
+		return
+	}
+
+	// range requests of limited links are counted too, or the whole file could be fetched by bytes=0-
+	if r.Method == "GET" && (r.Header.Get("Range") == "" || link.MaxDownloads > 0) {
+		if err := s.Shares.countDownload(link.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(info.Name()))
+	s.serveFile(w, r, realPath)
+}
+
+// shareUpload saves file into a drop box folder, existing files are never overwritten
+func (s *HTTPStaticServer) shareUpload(w http.ResponseWriter, r *http.Request, link ShareLink, dirpath string) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer func() {
+		file.Close()
+		r.MultipartForm.RemoveAll()
+	}()
+	if err := checkFilename(header.Filename); err != nil || header.Filename == YAMLCONF {
+		http.Error(w, "Invalid filename", http.StatusForbidden)
+		return
+	}
+	dstPath := filepath.Join(dirpath, header.Filename)
+	auth := s.readAccessConf(dirpath)
+	entry := newAuditEntry(r, &auth, AuditUpload, true)
+	entry.AuthMethod, entry.TokenID = "share", link.ID
+	entry.Rule = "share link " + link.ID
+	entry.Path = path.Join(link.Path, header.Filename)
+	if !auth.writable(r, entry.Path) {
+		entry.Allowed = false
+		entry.Rule = "accessTables"
+		s.Audit.Log(entry)
+		http.Error(w, "Upload forbidden", http.StatusForbidden)
+		return
+	}
+	dst, err := s.fs().Create(dstPath, true)
+	if err != nil {
+		if os.IsExist(err) {
+			http.Error(w, "File already exists", http.StatusConflict)
+			return
+		}
+		log.Println("Create file:", err)
+		http.Error(w, "File create "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf := s.bufPool.Get().([]byte)
+	defer s.bufPool.Put(buf)
+	hash := sha256.New()
+	entry.Size, err = io.CopyBuffer(io.MultiWriter(dst, hash), file, buf)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	entry.Digest = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	s.Audit.Log(entry)
+	if err != nil {
+		s.fs().RemoveAll(dstPath)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShareStore(t *testing.T) {
+	ss, err := OpenShareStore("")
+	assert.Nil(t, err)
+
+	link := &ShareLink{Path: "/foo.txt", Mode: ShareRead, MaxDownloads: 1, ExpiresAt: time.Now().Add(time.Hour)}
+	assert.Nil(t, ss.Create(link, "secret"))
+	found, err := ss.Get(link.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, "/foo.txt", found.Path)
+	assert.Equal(t, hashPassword(found.Salt, "secret"), found.PasswordHash)
+
+	_, err = ss.Get(link.Token + "x")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, ss.countDownload(link.ID))
+	assert.NotNil(t, ss.countDownload(link.ID))
+
+	assert.Nil(t, ss.Revoke(link.ID, "", true))
+	_, err = ss.Get(link.Token)
+	assert.NotNil(t, err)
+
+	expired := &ShareLink{Path: "/", Mode: ShareUpload, ExpiresAt: time.Now().Add(-time.Second)}
+	assert.Nil(t, ss.Create(expired, ""))
+	_, err = ss.Get(expired.Token)
+	assert.NotNil(t, err)
+	assert.NotNil(t, ss.Create(&ShareLink{Mode: "write"}, ""))
+}
+
+func TestShareOwner(t *testing.T) {
+	ss, err := OpenShareStore("")
+	assert.Nil(t, err)
+	anonymous := &ShareLink{Path: "/a.txt", Mode: ShareRead, ExpiresAt: time.Now().Add(time.Hour)}
+	alice := &ShareLink{Path: "/b.txt", Mode: ShareRead, Creator: "http:alice", ExpiresAt: time.Now().Add(time.Hour)}
+	assert.Nil(t, ss.Create(anonymous, ""))
+	assert.Nil(t, ss.Create(alice, ""))
+
+	assert.Empty(t, ss.List("", false))
+	assert.NotNil(t, ss.Revoke(anonymous.ID, "", false))
+	assert.Empty(t, ss.List("http:bob", false))
+	assert.NotNil(t, ss.Revoke(alice.ID, "http:bob", false))
+	links := ss.List("http:alice", false)
+	assert.Len(t, links, 1)
+	assert.Equal(t, alice.Token, links[0].Token)
+
+	// admins see all the links, but not the urls of others
+	links = ss.List("admin@example.com", true)
+	assert.Len(t, links, 2)
+	for _, l := range links {
+		assert.Empty(t, l.Token)
+	}
+	assert.Nil(t, ss.Revoke(anonymous.ID, "admin@example.com", true))
+
+	s := NewHTTPStaticServer(t.TempDir(), true)
+	s.Shares = ss
+	defer func(authType string) { gcfg.Auth.Type = authType }(gcfg.Auth.Type)
+	gcfg.Auth.Type = "http"
+	get := func(username string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/-/share?json=true", nil)
+		if username != "" {
+			r.SetBasicAuth(username, "pass")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	assert.Equal(t, http.StatusForbidden, get("").Code)
+	assert.NotContains(t, get("bob").Body.String(), alice.Token)
+	assert.Contains(t, get("alice").Body.String(), alice.Token)
+}
+
+func TestShareDownloadLimit(t *testing.T) {
+	root := t.TempDir()
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("0123456789"), 0644))
+	s := NewHTTPStaticServer(root, true)
+	link := &ShareLink{Path: "/a.txt", Mode: ShareRead, MaxDownloads: 1, ExpiresAt: time.Now().Add(time.Hour)}
+	assert.Nil(t, s.Shares.Create(link, ""))
+	get := func(rangeHeader string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/-/s/"+link.Token, nil)
+		r = mux.SetURLVars(r, map[string]string{"token": link.Token})
+		if rangeHeader != "" {
+			r.Header.Set("Range", rangeHeader)
+		}
+		w := httptest.NewRecorder()
+		s.hShareAccess(w, r)
+		return w
+	}
+	w := get("bytes=0-")
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "0123456789", w.Body.String())
+	assert.Equal(t, http.StatusGone, get("bytes=0-").Code)
+	assert.Equal(t, http.StatusGone, get("").Code)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	statsFilesBucket = []byte("files") // path -> downloads
+	statsDailyBucket = []byte("daily") // 2006-01-02 -> downloads
+)
+
+type FileStat struct {
+	Path      string `json:"path"`
+	Downloads uint64 `json:"downloads"`
+}
+
+type DailyStat struct {
+	Date      string `json:"date"`
+	Downloads uint64 `json:"downloads"`
+}
+
+// StatsStore keeps download counters in a bolt database, nil StatsStore counts nothing
+type StatsStore struct {
+	db *bolt.DB
+}
+
+func OpenStatsStore(filename string) (*StatsStore, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{statsFilesBucket, statsDailyBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &StatsStore{db: db}, nil
+}
+
+func decodeCount(v []byte) uint64 {
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func increase(b *bolt.Bucket, key []byte) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, decodeCount(b.Get(key))+1)
+	return b.Put(key, v)
+}
+
+// Count records a full download of relPath
+func (st *StatsStore) Count(relPath string) error {
+	if st == nil {
+		return nil
+	}
+	return st.db.Update(func(tx *bolt.Tx) error {
+		if err := increase(tx.Bucket(statsFilesBucket), []byte(relPath)); err != nil {
+			return err
+		}
+		return increase(tx.Bucket(statsDailyBucket), []byte(time.Now().Format("2006-01-02")))
+	})
+}
+
+// Downloads returns counters of files directly in dir, subdirectories are skipped without decoding
+func (st *StatsStore) Downloads(dir string) map[string]uint64 {
+	counts := make(map[string]uint64)
+	if st == nil {
+		return counts
+	}
+	prefix := []byte(strings.TrimSuffix(dir, "/") + "/")
+	st.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(statsFilesBucket).Cursor()
+		k, v := c.Seek(prefix)
+		for k != nil && bytes.HasPrefix(k, prefix) {
+			if i := bytes.IndexByte(k[len(prefix):], '/'); i >= 0 {
+				// '0' follows '/', seek past every key of the subdirectory
+				next := append(append([]byte{}, k[:len(prefix)+i]...), '0')
+				k, v = c.Seek(next)
+				continue
+			}
+			counts[string(k)] = decodeCount(v)
+			k, v = c.Next()
+		}
+		return nil
+	})
+	return counts
+}
+
+func (st *StatsStore) Get(relPath string) uint64 {
+	var count uint64
+	if st == nil {
+		return count
+	}
+	st.db.View(func(tx *bolt.Tx) error {
+		count = decodeCount(tx.Bucket(statsFilesBucket).Get([]byte(relPath)))
+		return nil
+	})
+	return count
+}
+
+// Top returns files under prefix sorted by downloads, visible filters files the user can read
+func (st *StatsStore) Top(prefix string, n int, visible func(relPath string) bool) []FileStat {
+	stats := make([]FileStat, 0)
+	st.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(statsFilesBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			stats = append(stats, FileStat{Path: string(k), Downloads: decodeCount(v)})
+		}
+		return nil
+	})
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].Downloads > stats[j].Downloads
+	})
+	top := make([]FileStat, 0, n)
+	for _, stat := range stats {
+		if len(top) >= n {
+			break
+		}
+		if visible(stat.Path) {
+			top = append(top, stat)
+		}
+	}
+	return top
+}
+
+// Daily returns total downloads of the last days, oldest first
+func (st *StatsStore) Daily(days int) []DailyStat {
+	daily := make([]DailyStat, 0, days)
+	st.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(statsDailyBucket)
+		now := time.Now()
+		for i := days - 1; i >= 0; i-- {
+			date := now.AddDate(0, 0, -i).Format("2006-01-02")
+			daily = append(daily, DailyStat{Date: date, Downloads: decodeCount(b.Get([]byte(date)))})
+		}
+		return nil
+	})
+	return daily
+}
+
+// Remove counters of relPath and files under it
+func (st *StatsStore) Remove(relPath string) error {
+	if st == nil {
+		return nil
+	}
+	return st.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(statsFilesBucket)
+		if err := b.Delete([]byte(relPath)); err != nil {
+			return err
+		}
+		prefix := []byte(strings.TrimSuffix(relPath, "/") + "/")
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (st *StatsStore) Close() error {
+	return st.db.Close()
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	err    error
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// hStats returns the most downloaded files and the daily totals
+func (s *HTTPStaticServer) hStats(w http.ResponseWriter, r *http.Request) {
+	if s.Stats == nil {
+		http.Error(w, "Download statistics are not enabled, set --stats-file to enable", http.StatusNotFound)
+		return
+	}
+	top, days := 10, 30
+	for name, v := range map[string]*int{"top": &top, "days": &days} {
+		if value := r.FormValue(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 || n > 366 {
+				http.Error(w, "Invalid "+name+", must be 1-366", http.StatusBadRequest)
+				return
+			}
+			*v = n
+		}
+	}
+	prefix := "/" + strings.Trim(r.FormValue("path"), "/")
+	if prefix != "/" {
+		prefix += "/"
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"top": s.Stats.Top(prefix, top, func(relPath string) bool {
+			realPath := s.realPathOf(relPath)
+			auth := s.readAccessConf(realPath)
+			dirAuth := s.readAccessConf(filepath.Dir(realPath))
+			return s.isFile(realPath) && auth.canRead(r) && dirAuth.visible(r, relPath)
+		}),
+		"daily": s.Stats.Daily(days),
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghs-stats")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	st, err := OpenStatsStore(filepath.Join(dir, "stats.db"))
+	assert.NoError(t, err)
+	defer st.Close()
+
+	for _, p := range []string{"/a.txt", "/sub/b.txt", "/sub/b.txt", "/sub/c.txt"} {
+		assert.NoError(t, st.Count(p))
+	}
+	assert.Equal(t, uint64(2), st.Get("/sub/b.txt"))
+	assert.Equal(t, map[string]uint64{"/sub/b.txt": 2, "/sub/c.txt": 1}, st.Downloads("/sub"))
+
+	all := func(string) bool { return true }
+	assert.Equal(t, []FileStat{{"/sub/b.txt", 2}, {"/a.txt", 1}}, st.Top("/", 2, all))
+	assert.Equal(t, []FileStat{{"/sub/b.txt", 2}, {"/sub/c.txt", 1}}, st.Top("/sub/", 10, all))
+
+	daily := st.Daily(7)
+	assert.Len(t, daily, 7)
+	assert.Equal(t, uint64(4), daily[6].Downloads)
+
+	assert.NoError(t, st.Remove("/sub"))
+	assert.Equal(t, uint64(0), st.Get("/sub/b.txt"))
+	assert.Equal(t, uint64(1), st.Get("/a.txt"))
+}
+
+func TestStatsDownloadsChildren(t *testing.T) {
+	st, err := OpenStatsStore(filepath.Join(t.TempDir(), "stats.db"))
+	assert.NoError(t, err)
+	defer st.Close()
+
+	for _, p := range []string{"/a.txt", "/sub/b.txt", "/sub/deep/c.txt", "/sub/deep/more/d.txt", "/sub/e.txt", "/sub0.txt"} {
+		assert.NoError(t, st.Count(p))
+	}
+	assert.Equal(t, map[string]uint64{"/sub/b.txt": 1, "/sub/e.txt": 1}, st.Downloads("/sub"))
+	assert.Equal(t, map[string]uint64{"/a.txt": 1, "/sub0.txt": 1}, st.Downloads("/"))
+}
+
+func TestStatsHidden(t *testing.T) {
+	root := t.TempDir()
+	for name, data := range map[string]string{
+		"a.txt":   "a",
+		"b.txt":   "b",
+		".env":    "SECRET=1",
+		YAMLCONF:  "accessTables:\n- regex: '^b\\.txt$'\n  action: hide\n",
+		"c/d.txt": "d",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755)
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(root, name), []byte(data), 0644))
+	}
+	s := NewHTTPStaticServer(root, true)
+	s.Hidden = HiddenConf{Patterns: []string{".env"}}
+	var err error
+	s.Stats, err = OpenStatsStore(filepath.Join(t.TempDir(), "stats.db"))
+	assert.NoError(t, err)
+	defer s.Stats.Close()
+	for _, p := range []string{"/a.txt", "/b.txt", "/.env", "/c/d.txt"} {
+		assert.NoError(t, s.Stats.Count(p))
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/-/stats", nil))
+	var data struct {
+		Top []FileStat `json:"top"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+	var paths []string
+	for _, f := range data.Top {
+		paths = append(paths, f.Path)
+	}
+	sort.Strings(paths)
+	assert.Equal(t, []string{"/a.txt", "/c/d.txt"}, paths)
+}
+
+func TestStatsListing(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "sub"), 0755))
+	for _, name := range []string{"a.txt", "sub/b.txt"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(root, name), []byte(name), 0644))
+	}
+	s := NewHTTPStaticServer(root, true)
+	var err error
+	s.Stats, err = OpenStatsStore(filepath.Join(t.TempDir(), "stats.db"))
+	assert.NoError(t, err)
+	defer s.Stats.Close()
+	for _, p := range []string{"/a.txt", "/sub/b.txt", "/sub/b.txt"} {
+		assert.NoError(t, s.Stats.Count(p))
+	}
+	assert.NoError(t, s.makeIndex())
+
+	downloads := func(url string) map[string]uint64 {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		var data struct {
+			Files []HTTPFileInfo `json:"files"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+		counts := make(map[string]uint64)
+		for _, f := range data.Files {
+			counts[filepath.ToSlash(f.Path)] = f.Downloads
+		}
+		return counts
+	}
+	assert.Equal(t, map[string]uint64{"a.txt": 1, "sub": 0}, downloads("/?json=true"))
+	assert.Equal(t, map[string]uint64{"sub/b.txt": 2}, downloads("/?json=true&search=b.txt"))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Storage keeps the files which are served, names are the slash separated real paths
+// which are returned by realPathOf
+type Storage interface {
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error) // sorted by name
+	Open(name string) (File, error)
+	// Create truncates the file if it exists, os.ErrExist is returned instead when exclusive is true
+	Create(name string, exclusive bool) (io.WriteCloser, error)
+	MkdirAll(name string) error
+	RemoveAll(name string) error
+	Rename(oldname, newname string) error
+}
+
+// File is an opened file of a Storage, ReadAt and Seek make Range requests and zip reading possible
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// walker is implemented by storages which walk faster than reading every directory
+type walker interface {
+	Walk(root string, fn filepath.WalkFunc) error
+}
+
+// isReadOnly reports whether files of the storage can not be changed
+func isReadOnly(fs Storage) bool {
+	ro, ok := fs.(interface{ ReadOnly() bool })
+	return ok && ro.ReadOnly()
+}
+
+// rootStorage returns the storage of the files, nil if root is a local directory
+func rootStorage(cfg *Configure) (Storage, error) {
+	if cfg.Storage.Type != "s3" && isArchive(cfg.Root) {
+		a, err := openArchive(cfg.Root)
+		if err != nil {
+			return nil, err
+		}
+		return fsStorage{a}, nil
+	}
+	return newStorage(cfg.Storage)
+}
+
+// localStorage is the local filesystem
+type localStorage struct{}
+
+func (localStorage) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (localStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+func (localStorage) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (localStorage) Create(name string, exclusive bool) (io.WriteCloser, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if exclusive {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+	return os.OpenFile(name, flag, 0644)
+}
+
+func (localStorage) MkdirAll(name string) error {
+	return os.MkdirAll(name, os.ModePerm)
+}
+
+func (localStorage) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (localStorage) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (localStorage) Walk(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, fn)
+}
+
+// walkStorage is filepath.Walk on a Storage
+func walkStorage(fs Storage, root string, fn filepath.WalkFunc) error {
+	if w, ok := fs.(walker); ok {
+		return w.Walk(root, fn)
+	}
+	info, err := fs.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDir(fs, root, info, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkDir(fs Storage, name string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(name, info, nil)
+	}
+	if err := fn(name, info, nil); err != nil {
+		return err
+	}
+	infos, err := fs.ReadDir(name)
+	if err != nil {
+		return fn(name, info, err)
+	}
+	for _, fi := range infos {
+		err = walkDir(fs, path.Join(name, fi.Name()), fi, fn)
+		if err != nil && (!fi.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
+
+// readStorageFile is ioutil.ReadFile on a Storage
+func readStorageFile(fs Storage, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// openSized opens a file for zip.NewReader
+func openSized(fs Storage, name string) (File, int64, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// fileInfo is the os.FileInfo of storages without a real filesystem
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func sortFileInfos(infos []os.FileInfo) {
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+}
+
+// fs returns the storage of the files, local filesystem confined by the symlink policy if not set
+func (s *HTTPStaticServer) fs() Storage {
+	if s.Storage == nil {
+		return symlinkStorage{s: s}
+	}
+	return s.Storage
+}
+
+func (s *HTTPStaticServer) isDir(realPath string) bool {
+	info, err := s.fs().Stat(realPath)
+	return err == nil && info.IsDir()
+}
+
+func (s *HTTPStaticServer) isFile(realPath string) bool {
+	info, err := s.fs().Stat(realPath)
+	return err == nil && info.Mode().IsRegular()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// symlink policies of the local filesystem
+const (
+	SymlinkFollow           = "follow"             // follow symlinks anywhere
+	SymlinkFollowWithinRoot = "follow-within-root" // follow symlinks whose target is inside of root or the mount
+	SymlinkDeny             = "deny"               // hide symlinks
+)
+
+var errTooManyLinks = errors.New("too many levels of symbolic links")
+
+// symlinkInfo is the info of the target of a symlink, named as the symlink
+type symlinkInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi symlinkInfo) Name() string {
+	return fi.name
+}
+
+// isSymlink reports whether info is returned for a symlink
+func isSymlink(info os.FileInfo) bool {
+	_, ok := info.(symlinkInfo)
+	return ok || info.Mode()&os.ModeSymlink != 0
+}
+
+// resolvePath is filepath.EvalSymlinks which also works for paths not created yet
+func resolvePath(name string, depth int) (string, error) {
+	if depth > 255 {
+		return "", errTooManyLinks
+	}
+	resolved, err := filepath.EvalSymlinks(name)
+	if err == nil || !os.IsNotExist(err) {
+		return resolved, err
+	}
+	if info, err := os.Lstat(name); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		// dangling symlink, a new file is created at the target
+		target, err := os.Readlink(name)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(name), target)
+		}
+		return resolvePath(target, depth+1)
+	}
+	dir := filepath.Dir(name)
+	if dir == name {
+		return name, nil
+	}
+	parent, err := resolvePath(dir, depth+1)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(name)), nil
+}
+
+// symlinkPolicy returns the symlink policy, follow-within-root if not set
+func (s *HTTPStaticServer) symlinkPolicy() string {
+	if s.Symlinks == "" {
+		return SymlinkFollowWithinRoot
+	}
+	return s.Symlinks
+}
+
+// baseOf returns root or the path of the mount which realPath belongs to
+func (s *HTTPStaticServer) baseOf(realPath string) string {
+	base := s.Root
+	for _, m := range s.Mounts {
+		if isSubPath(m.Path, realPath) && (base == s.Root || len(m.Path) > len(base)) {
+			base = m.Path
+		}
+	}
+	return base
+}
+
+// confine checks realPath of the local filesystem against the symlink policy,
+// paths which are outside of root after resolving symlinks do not exist
+func (s *HTTPStaticServer) confine(op, realPath string) error {
+	policy := s.symlinkPolicy()
+	if s.Storage != nil || policy == SymlinkFollow {
+		return nil
+	}
+	notExist := &os.PathError{Op: op, Path: realPath, Err: os.ErrNotExist}
+	base := s.baseOf(realPath)
+	if !isSubPath(base, realPath) {
+		return notExist
+	}
+	if policy == SymlinkDeny {
+		rel, _ := filepath.Rel(base, realPath)
+		p := base
+		for _, elem := range strings.Split(filepath.ToSlash(rel), "/") {
+			if elem == "." {
+				continue
+			}
+			p = filepath.Join(p, elem)
+			info, err := os.Lstat(p)
+			if err != nil {
+				break // not created yet
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				return notExist
+			}
+		}
+		return nil
+	}
+	resolvedBase, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolvePath(realPath, 0)
+	if err != nil {
+		return &os.PathError{Op: op, Path: realPath, Err: err}
+	}
+	// symlinks may point to absolute paths while root is relative
+	resolvedBase, _ = filepath.Abs(resolvedBase)
+	resolved, _ = filepath.Abs(resolved)
+	if !isSubPath(resolvedBase, resolved) {
+		return notExist
+	}
+	return nil
+}
+
+// followSymlink returns the info of the target of the symlink name, false if it is hidden by the policy
+func (s *HTTPStaticServer) followSymlink(name string, link os.FileInfo) (os.FileInfo, bool) {
+	if s.symlinkPolicy() == SymlinkDeny || s.confine("stat", name) != nil {
+		return nil, false
+	}
+	info, err := os.Stat(name)
+	if err != nil { // dangling
+		return nil, false
+	}
+	return symlinkInfo{FileInfo: info, name: link.Name()}, true
+}
+
+// symlinkStorage is the local filesystem confined by the symlink policy
+type symlinkStorage struct {
+	localStorage
+	s *HTTPStaticServer
+}
+
+func (fs symlinkStorage) Stat(name string) (os.FileInfo, error) {
+	if err := fs.s.confine("stat", name); err != nil {
+		return nil, err
+	}
+	return fs.localStorage.Stat(name)
+}
+
+// ReadDir returns the targets of symlinks, symlinks hidden by the policy are left out
+func (fs symlinkStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	if err := fs.s.confine("open", name); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	visible := infos[:0]
+	for _, info := range infos {
+		if info.Mode()&os.ModeSymlink != 0 {
+			var ok bool
+			if info, ok = fs.s.followSymlink(filepath.Join(name, info.Name()), info); !ok {
+				continue
+			}
+		}
+		visible = append(visible, info)
+	}
+	return visible, nil
+}
+
+func (fs symlinkStorage) Open(name string) (File, error) {
+	if err := fs.s.confine("open", name); err != nil {
+		return nil, err
+	}
+	return fs.localStorage.Open(name)
+}
+
+func (fs symlinkStorage) Create(name string, exclusive bool) (io.WriteCloser, error) {
+	if err := fs.s.confine("open", name); err != nil {
+		return nil, err
+	}
+	return fs.localStorage.Create(name, exclusive)
+}
+
+func (fs symlinkStorage) MkdirAll(name string) error {
+	if err := fs.s.confine("mkdir", name); err != nil {
+		return err
+	}
+	return fs.localStorage.MkdirAll(name)
+}
+
+func (fs symlinkStorage) RemoveAll(name string) error {
+	if err := fs.s.confine("remove", name); err != nil {
+		return err
+	}
+	return fs.localStorage.RemoveAll(name)
+}
+
+func (fs symlinkStorage) Rename(oldname, newname string) error {
+	if err := fs.s.confine("rename", oldname); err != nil {
+		return err
+	}
+	if err := fs.s.confine("rename", newname); err != nil {
+		return err
+	}
+	return fs.localStorage.Rename(oldname, newname)
+}
+
+// Walk reports symlinks as their targets, symlinked directories are not walked into to avoid loops
+func (fs symlinkStorage) Walk(root string, fn filepath.WalkFunc) error {
+	if err := fs.s.confine("lstat", root); err != nil {
+		return fn(root, nil, err)
+	}
+	walkRoot := root
+	if info, err := os.Lstat(root); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if walkRoot, err = filepath.EvalSymlinks(root); err != nil {
+			return fn(root, nil, err)
+		}
+	}
+	return filepath.Walk(walkRoot, func(name string, info os.FileInfo, err error) error {
+		name = root + strings.TrimPrefix(name, walkRoot)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			var ok bool
+			if info, ok = fs.s.followSymlink(name, info); !ok || info.IsDir() {
+				return nil
+			}
+		}
+		return fn(name, info, err)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSymlinkServer(t *testing.T, policy string) (root, outside string, s *HTTPStaticServer) {
+	root, outside = t.TempDir(), t.TempDir()
+	os.MkdirAll(filepath.Join(root, "docs/sub"), 0755)
+	for name, data := range map[string]string{
+		filepath.Join(root, "docs/a.txt"): "a",
+		filepath.Join(outside, "o.txt"):   "o",
+	} {
+		assert.Nil(t, ioutil.WriteFile(name, []byte(data), 0644))
+	}
+	for link, target := range map[string]string{
+		"in.txt":   "docs/a.txt",
+		"indir":    "docs",
+		"out.txt":  filepath.Join(outside, "o.txt"),
+		"outdir":   outside,
+		"dangling": filepath.Join(outside, "new.txt"),
+	} {
+		assert.Nil(t, os.Symlink(target, filepath.Join(root, link)))
+	}
+	s = NewHTTPStaticServer(root, true)
+	s.Upload, s.Delete = true, true
+	s.Symlinks = policy
+	return
+}
+
+func TestSymlinkFollowWithinRoot(t *testing.T) {
+	root, outside, s := newSymlinkServer(t, "")
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+	assert.Equal(t, "a", get("/in.txt").Body.String())
+	assert.Equal(t, "a", get("/indir/a.txt").Body.String())
+	assert.Equal(t, http.StatusNotFound, get("/out.txt").Code)
+	assert.Equal(t, http.StatusNotFound, get("/outdir/o.txt").Code)
+
+	var list struct {
+		Files []HTTPFileInfo `json:"files"`
+	}
+	assert.Nil(t, json.Unmarshal(get("/?json=true").Body.Bytes(), &list))
+	files := make(map[string]HTTPFileInfo)
+	for _, f := range list.Files {
+		files[f.Path] = f
+	}
+	assert.Len(t, files, 3)
+	assert.False(t, files["docs"].Symlink)
+	assert.True(t, files["in.txt"].Symlink)
+	assert.Equal(t, "file", files["in.txt"].Type)
+	assert.Equal(t, int64(1), files["in.txt"].Size)
+	assert.True(t, files["indir"].Symlink)
+	assert.Equal(t, "dir", files["indir"].Type)
+
+	upload := func(url, filename string) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", filename)
+		fw.Write([]byte("x"))
+		mw.Close()
+		r := httptest.NewRequest("POST", url, &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, upload("/indir", "b.txt"))
+	assert.True(t, fileExists(filepath.Join(root, "docs/b.txt")))
+	assert.NotEqual(t, http.StatusOK, upload("/outdir", "b.txt"))
+	assert.NotEqual(t, http.StatusOK, upload("/", "dangling"))
+	assert.False(t, fileExists(filepath.Join(outside, "b.txt")))
+	assert.False(t, fileExists(filepath.Join(outside, "new.txt")))
+
+	del := func(url string) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("DELETE", url, nil))
+		return w.Code
+	}
+	assert.Equal(t, http.StatusForbidden, del("/"))
+	assert.NotEqual(t, http.StatusOK, del("/outdir/o.txt"))
+	assert.True(t, fileExists(filepath.Join(outside, "o.txt")))
+	assert.Equal(t, http.StatusOK, del("/in.txt"))
+	assert.True(t, fileExists(filepath.Join(root, "docs/a.txt")))
+}
+
+func TestSymlinkPolicy(t *testing.T) {
+	_, _, s := newSymlinkServer(t, SymlinkDeny)
+	_, err := s.fs().Stat(s.realPathOf("/in.txt"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = s.fs().Stat(s.realPathOf("/indir/a.txt"))
+	assert.True(t, os.IsNotExist(err))
+	infos, err := s.fs().ReadDir(s.realPathOf("/"))
+	assert.Nil(t, err)
+	assert.Len(t, infos, 1)
+	var names []string
+	walkStorage(s.fs(), s.realPathOf("/"), func(path string, info os.FileInfo, err error) error {
+		names = append(names, s.relativePath(path))
+		return nil
+	})
+	assert.Equal(t, []string{"/", "/docs", "/docs/a.txt", "/docs/sub"}, names)
+
+	_, _, s = newSymlinkServer(t, SymlinkFollow)
+	data, err := readStorageFile(s.fs(), s.realPathOf("/out.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "o", string(data))
+}
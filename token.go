@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Scopes of api tokens, admin implies all the others
+const (
+	ScopeRead   = "read"
+	ScopeUpload = "upload"
+	ScopeDelete = "delete"
+	ScopeAdmin  = "admin"
+)
+
+var validScopes = []string{ScopeRead, ScopeUpload, ScopeDelete, ScopeAdmin}
+
+// APIToken is a server managed token, only the sha256 of the token is stored
+type APIToken struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Owner      string    `json:"owner,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	Scopes     []string  `json:"scopes"`
+	Paths      []string  `json:"paths,omitempty"` // empty means everywhere
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"` // zero means never
+	LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+func (t *APIToken) expired() bool {
+	return !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt)
+}
+
+// allow check if the token has scope on path, path is relative to root, eg: /foo/bar.txt
+func (t *APIToken) allow(scope string, relPath string) bool {
+	hasScope := false
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			hasScope = true
+			break
+		}
+	}
+	if !hasScope {
+		return false
+	}
+	if len(t.Paths) == 0 {
+		return true
+	}
+	relPath = path.Clean("/" + relPath)
+	for _, p := range t.Paths {
+		p = path.Clean("/" + p)
+		if p == "/" || relPath == p || strings.HasPrefix(relPath, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type TokenStore struct {
+	path     string
+	mu       sync.Mutex
+	tokens   []*APIToken
+	lastSave time.Time
+	modTime  time.Time // of the file when loaded or saved
+	size     int64
+}
+
+// OpenTokenStore loads tokens from a json file, the file is created on first save
+func OpenTokenStore(filename string) (*TokenStore, error) {
+	ts := &TokenStore{path: filename}
+	if err := ts.reload(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// reload reads the file again if it is changed by another process, eg: gohttpserver token revoke.
+// Last used times which are not saved yet are kept.
+func (ts *TokenStore) reload() error {
+	info, err := os.Stat(ts.path)
+	if os.IsNotExist(err) {
+		ts.tokens, ts.modTime, ts.size = nil, time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(ts.modTime) && info.Size() == ts.size {
+		return nil
+	}
+	data, err := ioutil.ReadFile(ts.path)
+	if err != nil {
+		return err
+	}
+	var tokens []*APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("token file %s: %v", ts.path, err)
+	}
+	lastUsed := make(map[string]time.Time, len(ts.tokens))
+	for _, t := range ts.tokens {
+		lastUsed[t.ID] = t.LastUsedAt
+	}
+	for _, t := range tokens {
+		if lastUsed[t.ID].After(t.LastUsedAt) {
+			t.LastUsedAt = lastUsed[t.ID]
+		}
+	}
+	ts.tokens, ts.modTime, ts.size = tokens, info.ModTime(), info.Size()
+	return nil
+}
+
+func (ts *TokenStore) save() error {
+	data, err := json.MarshalIndent(ts.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := ts.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	ts.lastSave = time.Now()
+	if err := os.Rename(tmpPath, ts.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(ts.path); err == nil {
+		ts.modTime, ts.size = info.ModTime(), info.Size()
+	}
+	return nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Create returns the secret which is only visible this time
+func (ts *TokenStore) Create(name, owner string, scopes, paths []string, ttl time.Duration) (secret string, token APIToken, err error) {
+	if len(scopes) == 0 {
+		return "", token, errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !stringInSlice(scope, validScopes) {
+			return "", token, fmt.Errorf("invalid scope %s, must be one of %s", strconv.Quote(scope), strings.Join(validScopes, ","))
+		}
+	}
+	id := randomHex(4)
+	secret = "ghs_" + id + "_" + randomHex(20)
+	t := &APIToken{
+		ID:        id,
+		Name:      name,
+		Owner:     owner,
+		Hash:      hashToken(secret),
+		Scopes:    scopes,
+		Paths:     paths,
+		CreatedAt: time.Now(),
+	}
+	if ttl > 0 {
+		t.ExpiresAt = t.CreatedAt.Add(ttl)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err = ts.reload(); err != nil {
+		return "", token, err
+	}
+	ts.tokens = append(ts.tokens, t)
+	if err = ts.save(); err != nil {
+		ts.tokens = ts.tokens[:len(ts.tokens)-1]
+		return "", token, err
+	}
+	return secret, t.public(), nil
+}
+
+// public returns a copy without hash
+func (t *APIToken) public() APIToken {
+	pt := *t
+	pt.Hash = ""
+	return pt
+}
+
+func (ts *TokenStore) List() []APIToken {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.reload(); err != nil {
+		log.Println("reload tokens:", err)
+	}
+	tokens := make([]APIToken, 0, len(ts.tokens))
+	for _, t := range ts.tokens {
+		tokens = append(tokens, t.public())
+	}
+	return tokens
+}
+
+func (ts *TokenStore) Revoke(id string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.reload(); err != nil {
+		return err
+	}
+	for i, t := range ts.tokens {
+		if t.ID == id {
+			tokens := ts.tokens
+			ts.tokens = append(append([]*APIToken{}, tokens[:i]...), tokens[i+1:]...)
+			if err := ts.save(); err != nil {
+				ts.tokens = tokens
+				return err
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("token %s not found", strconv.Quote(id))
+}
+
+// Lookup returns the valid token which matches secret, last used time is updated
+func (ts *TokenStore) Lookup(secret string) (*APIToken, bool) {
+	hash := hashToken(secret)
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.reload(); err != nil { // tokens revoked by other processes must not be accepted
+		log.Println("reload tokens:", err)
+		return nil, false
+	}
+	for _, t := range ts.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		if t.expired() {
+			return nil, false
+		}
+		t.LastUsedAt = time.Now()
+		if time.Since(ts.lastSave) > time.Minute { // save last used time lazily
+			ts.save()
+		}
+		pt := t.public()
+		return &pt, true
+	}
+	return nil, false
+}
+
+type contextKey int
+
+const (
+	ctxKeyToken contextKey = iota
+	ctxKeyProxyUser
+	ctxKeyS3
+	ctxKeySFTP
+	ctxKeyMetrics
+)
+
+// requestToken returns the api token used by the request, nil if not authenticated by token
+func requestToken(r *http.Request) *APIToken {
+	t, _ := r.Context().Value(ctxKeyToken).(*APIToken)
+	return t
+}
+
+func bearerToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return ""
+}
+
+// bearerTokenAuth checks header "Authorization: Bearer <token>". Requests with a valid
+// token go to authorized directly, which skip the login of auth-type, others go to fallback.
+func bearerTokenAuth(ts *TokenStore, authorized, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := bearerToken(r)
+		if secret == "" {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		token, ok := ts.Lookup(secret)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), ctxKeyToken, token)
+		authorized.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// parseExpires parse duration like 720h or 30d, empty means never expire
+func parseExpires(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid expires %s", strconv.Quote(s))
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func (s *HTTPStaticServer) hTokens(w http.ResponseWriter, r *http.Request) {
+	if s.Tokens == nil {
+		http.Error(w, "API tokens are not enabled, set --token-file to enable", http.StatusNotFound)
+		return
+	}
+	if !isAdmin(r) {
+		http.Error(w, "Admin required", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if r.Method == "GET" {
+		json.NewEncoder(w).Encode(s.Tokens.List())
+		return
+	}
+
+	ttl, err := parseExpires(r.FormValue("expires"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	owner := r.FormValue("owner")
+	if owner == "" {
+		if user := currentUser(r); user != nil {
+			owner = user.Email
+		}
+	}
+	secret, token, err := s.Tokens.Create(r.FormValue("name"), owner, r.Form["scope"], r.Form["path"], ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token": secret,
+		"info":  token,
+	})
+}
+
+func (s *HTTPStaticServer) hTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	if s.Tokens == nil {
+		http.Error(w, "API tokens are not enabled, set --token-file to enable", http.StatusNotFound)
+		return
+	}
+	if !isAdmin(r) {
+		http.Error(w, "Admin required", http.StatusForbidden)
+		return
+	}
+	if err := s.Tokens.Revoke(mux.Vars(r)["id"]); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Write([]byte("Success"))
+}
+
+type tokenCommandArgs struct {
+	Name    string
+	Owner   string
+	Scopes  []string
+	Paths   []string
+	Expires string
+	ID      string
+}
+
+var tokenArgs tokenCommandArgs
+
+// runTokenCommand handles subcommands: token create|list|revoke
+func runTokenCommand(command string) error {
+	if gcfg.TokenFile == "" {
+		return errors.New("--token-file is required")
+	}
+	ts, err := OpenTokenStore(gcfg.TokenFile)
+	if err != nil {
+		return err
+	}
+	switch command {
+	case "token create":
+		ttl, err := parseExpires(tokenArgs.Expires)
+		if err != nil {
+			return err
+		}
+		secret, token, err := ts.Create(tokenArgs.Name, tokenArgs.Owner, tokenArgs.Scopes, tokenArgs.Paths, ttl)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Token %s created, it will not be shown again\n%s\n", token.ID, secret)
+	case "token list":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tOWNER\tSCOPES\tPATHS\tEXPIRES\tLAST USED")
+		for _, t := range ts.List() {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Name, t.Owner,
+				strings.Join(t.Scopes, ","), strings.Join(t.Paths, ","), formatTime(t.ExpiresAt), formatTime(t.LastUsedAt))
+		}
+		tw.Flush()
+	case "token revoke":
+		if err := ts.Revoke(tokenArgs.ID); err != nil {
+			return err
+		}
+		fmt.Printf("Token %s revoked\n", tokenArgs.ID)
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04")
+}
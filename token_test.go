@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPITokenAllow(t *testing.T) {
+	token := &APIToken{Scopes: []string{ScopeUpload}, Paths: []string{"/foo"}}
+	assert.True(t, token.allow(ScopeUpload, "/foo"))
+	assert.True(t, token.allow(ScopeUpload, "/foo/bar.txt"))
+	assert.False(t, token.allow(ScopeUpload, "/foobar"))
+	assert.False(t, token.allow(ScopeUpload, "/foo/../bar"))
+	assert.False(t, token.allow(ScopeDelete, "/foo/bar.txt"))
+
+	admin := &APIToken{Scopes: []string{ScopeAdmin}}
+	assert.True(t, admin.allow(ScopeDelete, "/any/where"))
+}
+
+func TestAPITokenOwner(t *testing.T) {
+	gcfg.Admins = []string{"admin@example.com"}
+	defer func() { gcfg.Admins = nil }()
+	no := false
+	ac := &AccessConf{
+		Read:   true,
+		List:   true,
+		Upload: false,
+		Users: []UserControl{
+			{Email: "bob@example.com", Read: &no, List: &no},
+			{Email: "alice@example.com", Role: RoleMaintainer},
+		},
+		path: "/docs/a.txt",
+	}
+	request := func(token *APIToken) *http.Request {
+		r := httptest.NewRequest("GET", "/docs/a.txt", nil)
+		return r.WithContext(context.WithValue(r.Context(), ctxKeyToken, token))
+	}
+
+	all := []string{ScopeRead, ScopeUpload, ScopeDelete}
+	bob := request(&APIToken{Owner: "bob@example.com", Scopes: all})
+	assert.False(t, ac.canRead(bob), "denied owner")
+	assert.False(t, ac.canList(bob))
+
+	alice := request(&APIToken{Owner: "alice@example.com", Scopes: []string{ScopeRead, ScopeUpload}})
+	assert.True(t, ac.canRead(alice))
+	assert.True(t, ac.canUpload(alice))
+	assert.False(t, ac.canDelete(alice), "maintainer, but no delete scope")
+
+	carol := request(&APIToken{Owner: "carol@example.com", Scopes: all})
+	assert.True(t, ac.canRead(carol))
+	assert.False(t, ac.canUpload(carol), "upload is off by default")
+
+	operator := request(&APIToken{Scopes: []string{ScopeUpload}})
+	assert.True(t, ac.canUpload(operator), "tokens without owner are only limited by scopes")
+	assert.False(t, ac.canDelete(operator))
+
+	assert.False(t, isAdmin(request(&APIToken{Owner: "carol@example.com", Scopes: []string{ScopeAdmin}})))
+	assert.True(t, isAdmin(request(&APIToken{Owner: "admin@example.com", Scopes: []string{ScopeAdmin}})))
+	assert.True(t, isAdmin(request(&APIToken{Scopes: []string{ScopeAdmin}})))
+	assert.False(t, isAdmin(request(&APIToken{Owner: "admin@example.com", Scopes: []string{ScopeRead}})))
+}
+
+func TestTokenStore(t *testing.T) {
+	ts, err := OpenTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	assert.Nil(t, err)
+	secret, token, err := ts.Create("ci", "", []string{ScopeRead}, nil, time.Hour)
+	assert.Nil(t, err)
+
+	found, ok := ts.Lookup(secret)
+	assert.True(t, ok)
+	assert.Equal(t, token.ID, found.ID)
+	assert.Empty(t, found.Hash)
+
+	_, ok = ts.Lookup(secret + "x")
+	assert.False(t, ok)
+
+	_, _, err = ts.Create("bad", "", []string{"write"}, nil, 0)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, ts.Revoke(token.ID))
+	_, ok = ts.Lookup(secret)
+	assert.False(t, ok)
+}
+
+func TestParseExpires(t *testing.T) {
+	d, err := parseExpires("30d")
+	assert.Nil(t, err)
+	assert.Equal(t, 30*24*time.Hour, d)
+	d, err = parseExpires("2h")
+	assert.Nil(t, err)
+	assert.Equal(t, 2*time.Hour, d)
+	_, err = parseExpires("xd")
+	assert.NotNil(t, err)
+}
+
+func TestTokenStoreReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tokens.json")
+	server, err := OpenTokenStore(filename)
+	assert.Nil(t, err)
+	secret, token, err := server.Create("ci", "", []string{ScopeRead}, nil, 0)
+	assert.Nil(t, err)
+
+	// gohttpserver token create|revoke, while the server is running
+	cli, err := OpenTokenStore(filename)
+	assert.Nil(t, err)
+	assert.Nil(t, cli.Revoke(token.ID))
+	secret2, token2, err := cli.Create("deploy", "", []string{ScopeUpload}, nil, 0)
+	assert.Nil(t, err)
+
+	_, ok := server.Lookup(secret)
+	assert.False(t, ok)
+	server.lastSave = time.Time{} // the last used time is saved
+	_, ok = server.Lookup(secret2)
+	assert.True(t, ok)
+	cli, err = OpenTokenStore(filename)
+	assert.Nil(t, err)
+	tokens := cli.List()
+	assert.Len(t, tokens, 1)
+	assert.Equal(t, token2.ID, tokens[0].ID)
+	assert.False(t, tokens[0].LastUsedAt.IsZero())
+
+	// revoked tokens are kept if they can not be saved
+	assert.Nil(t, os.Mkdir(filename+".tmp", 0755))
+	assert.NotNil(t, server.Revoke(token2.ID))
+	_, ok = server.Lookup(secret2)
+	assert.True(t, ok)
+	assert.Len(t, server.List(), 1)
+}
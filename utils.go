@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -92,7 +93,54 @@ func isFile(path string) bool {
 	return err == nil && info.Mode().IsRegular()
 }
 
+func stringInSlice(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 func isDir(path string) bool {
 	info, err := os.Stat(path)
 	return err == nil && info.Mode().IsDir()
 }
+
+// negotiate returns the offer which the Accept header prefers, the first offer if accept is empty
+// or nothing is acceptable. With the same quality, offers named exactly win over wildcards.
+func negotiate(accept string, offers ...string) string {
+	best, bestQ, bestLevel := offers[0], 0.0, -1
+	if strings.TrimSpace(accept) == "" {
+		return best
+	}
+	for _, offer := range offers {
+		q, specific := 0.0, -1
+		for _, part := range strings.Split(accept, ",") {
+			fields := strings.Split(part, ";")
+			mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+			level := -1
+			switch {
+			case mediaType == offer:
+				level = 2
+			case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(offer, mediaType[:len(mediaType)-1]):
+				level = 1
+			case mediaType == "*/*" || mediaType == "*":
+				level = 0
+			}
+			if level <= specific {
+				continue
+			}
+			specific, q = level, 1.0
+			for _, param := range fields[1:] {
+				if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && kv[0] == "q" {
+					q, _ = strconv.ParseFloat(kv[1], 64)
+				}
+			}
+		}
+		if q > bestQ || (q == bestQ && q > 0 && specific > bestLevel) {
+			best, bestQ, bestLevel = offer, q, specific
+		}
+	}
+	return best
+}
@@ -47,3 +47,28 @@ func TestCleanPath(t *testing.T) {
 		}
 	}
 }
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"text/html", "application/json", "text/plain"}
+	tests := []struct {
+		accept string
+		expect string
+	}{
+		{"", "text/html"},
+		{"*/*", "text/html"},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html"},
+		{"application/json", "application/json"},
+		{"application/json, text/plain, */*", "application/json"},
+		{"text/plain", "text/plain"},
+		{"text/*;q=0.5, text/plain", "text/plain"},
+		{"text/html;q=0.1, application/json", "application/json"},
+		{"text/html;q=0, */*;q=0.5", "application/json"},
+		{"image/png", "text/html"},
+	}
+	for _, v := range tests {
+		res := negotiate(v.accept, offers...)
+		if res != v.expect {
+			t.Fatalf("Failed: %v - res:%v", v, res)
+		}
+	}
+}
@@ -32,32 +32,23 @@ func sanitizedName(filename string) string {
 	return filename
 }
 
-func statFile(filename string) (info os.FileInfo, reader io.ReadCloser, err error) {
-	info, err = os.Lstat(filename)
-	if err != nil {
-		return
-	}
-	// content
-	if info.Mode()&os.ModeSymlink != 0 {
-		var target string
-		target, err = os.Readlink(filename)
-		if err != nil {
-			return
-		}
-		reader = ioutil.NopCloser(bytes.NewBuffer([]byte(target)))
-	} else if !info.IsDir() {
-		reader, err = os.Open(filename)
+// openZipEntry returns the content of a file, the target of a symlink or nothing for a directory
+func openZipEntry(fs Storage, name string, info os.FileInfo) (io.ReadCloser, error) {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0: // only the local filesystem has symlinks
+		target, err := os.Readlink(name)
 		if err != nil {
-			return
+			return nil, err
 		}
-	} else {
-		reader = ioutil.NopCloser(bytes.NewBuffer(nil))
+		return ioutil.NopCloser(bytes.NewBuffer([]byte(target))), nil
+	case info.IsDir():
+		return ioutil.NopCloser(bytes.NewBuffer(nil)), nil
 	}
-	return
+	return fs.Open(name)
 }
 
-func (z *Zip) Add(relpath, abspath string) error {
-	info, rdc, err := statFile(abspath)
+func (z *Zip) Add(fs Storage, relpath, name string, info os.FileInfo) error {
+	rdc, err := openZipEntry(fs, name, info)
 	if err != nil {
 		return err
 	}
@@ -80,7 +71,8 @@ func (z *Zip) Add(relpath, abspath string) error {
 	return err
 }
 
-func CompressToZip(w http.ResponseWriter, rootDir string) {
+// CompressToZip writes rootDir of fs as zip into w, files or directories are skipped when visible returns false
+func CompressToZip(w http.ResponseWriter, fs Storage, rootDir string, visible func(path string, info os.FileInfo) bool) {
 	rootDir = filepath.Clean(rootDir)
 	zipFileName := filepath.Base(rootDir) + ".zip"
 
@@ -90,21 +82,34 @@ func CompressToZip(w http.ResponseWriter, rootDir string) {
 	zw := &Zip{Writer: zip.NewWriter(w)}
 	defer zw.Close()
 
-	filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+	walkStorage(fs, rootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
 		zipPath := path[len(rootDir):]
 		if info.Name() == YAMLCONF { // ignore .ghs.yml for security
 			return nil
 		}
-		return zw.Add(zipPath, path)
+		if visible != nil && !visible(path, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return zw.Add(fs, zipPath, path, info)
 	})
 }
 
-func ExtractFromZip(zipFile, path string, w io.Writer) (err error) {
-	cf, err := zip.OpenReader(zipFile)
+func ExtractFromZip(fs Storage, zipFile, path string, w io.Writer) (err error) {
+	f, size, err := openSized(fs, zipFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	cf, err := zip.NewReader(f, size)
 	if err != nil {
 		return
 	}
-	defer cf.Close()
 
 	rd := ioutil.NopCloser(bytes.NewBufferString(path))
 	patterns, err := dkignore.ReadIgnore(rd)
@@ -132,24 +137,25 @@ func ExtractFromZip(zipFile, path string, w io.Writer) (err error) {
 	return fmt.Errorf("File %s not found", strconv.Quote(path))
 }
 
-func unzipFile(filename, dest string) error {
-	zr, err := zip.OpenReader(filename)
+// unzipFile extracts filename of fs into dest, the directory of filename if dest is empty.
+// Nothing is extracted if an entry is outside of dest or allow returns false for it.
+func unzipFile(fs Storage, filename, dest string, allow func(fpath string) bool) error {
+	zf, size, err := openSized(fs, filename)
+	if err != nil {
+		return err
+	}
+	defer zf.Close()
+	zr, err := zip.NewReader(zf, size)
 	if err != nil {
 		return err
 	}
-	defer zr.Close()
 
 	if dest == "" {
 		dest = filepath.Dir(filename)
 	}
 
+	fpaths := make(map[*zip.File]string, len(zr.File))
 	for _, f := range zr.File {
-		rc, err := f.Open()
-		if err != nil {
-			return err
-		}
-		defer rc.Close()
-
 		// ignore .ghs.yml
 		filename := sanitizedName(f.Name)
 		if filepath.Base(filename) == ".ghs.yml" {
@@ -167,18 +173,43 @@ func unzipFile(filename, dest string) error {
 			}
 		}
 
+		if !isSubPath(dest, fpath) {
+			return fmt.Errorf("%s is outside of the destination", strconv.Quote(f.Name))
+		}
+		if allow != nil && !allow(fpath) {
+			return fmt.Errorf("%s is forbidden", strconv.Quote(f.Name))
+		}
+		fpaths[f] = fpath
+	}
+
+	for _, f := range zr.File {
+		fpath, ok := fpaths[f]
+		if !ok {
+			continue
+		}
 		if f.FileInfo().IsDir() {
-			os.MkdirAll(fpath, os.ModePerm)
+			fs.MkdirAll(fpath)
 			continue
 		}
 
-		os.MkdirAll(filepath.Dir(fpath), os.ModePerm)
-		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		fs.MkdirAll(filepath.Dir(fpath))
+		outFile, err := fs.Create(fpath, false)
 		if err != nil {
 			return err
 		}
+		if lf, ok := outFile.(*os.File); ok {
+			lf.Chmod(f.Mode())
+		}
 		_, err = io.Copy(outFile, rc)
-		outFile.Close()
+		if closeErr := outFile.Close(); err == nil {
+			err = closeErr
+		}
 
 		if err != nil {
 			return err
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -9,7 +12,7 @@ import (
 
 func TestExtractFromZip(t *testing.T) {
 	buf := bytes.NewBuffer(nil)
-	err := ExtractFromZip("testdata/test.zip", "**/foo.txt", buf)
+	err := ExtractFromZip(localStorage{}, "testdata/test.zip", "**/foo.txt", buf)
 	assert.Nil(t, err)
 	t.Log("Content: " + buf.String())
 }
@@ -18,3 +21,25 @@ func TestExtractFromZip(t *testing.T) {
 //	err := unzipFile("testdata.zip", "./tmp")
 //	assert.Nil(t, err)
 //}
+
+func TestUnzipFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, entries := range map[string][]string{
+		"ok.zip":   {"a/b.txt"},
+		"slip.zip": {"ok.txt", "../evil.txt"},
+	} {
+		f, _ := os.Create(filepath.Join(dir, name))
+		zw := zip.NewWriter(f)
+		for _, entry := range entries {
+			w, _ := zw.Create(entry)
+			w.Write([]byte(entry))
+		}
+		zw.Close()
+		f.Close()
+	}
+	dest := filepath.Join(dir, "dest")
+	assert.Nil(t, unzipFile(localStorage{}, filepath.Join(dir, "ok.zip"), dest, nil))
+	assert.True(t, fileExists(filepath.Join(dest, "a/b.txt")))
+	assert.Error(t, unzipFile(localStorage{}, filepath.Join(dir, "slip.zip"), dest, nil))
+	assert.False(t, fileExists(filepath.Join(dir, "evil.txt")))
+}